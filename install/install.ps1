@@ -1,6 +1,11 @@
 param (
     [string] $baseurl = "https://aadacr.blob.core.windows.net/acr-docker-credential-helper",
-    [switch] $skipCleanup
+    [switch] $skipCleanup,
+    # set the helper as the credsStore of all registries instead of the ACR registries found in the docker config
+    [switch] $global,
+    [string[]] $registrySuffix = @(),
+    # set the helper for registries that are not in the docker config yet
+    [string[]] $registry = @()
 )
 
 Write-Host "ACR Credential Helper currently does not support Windows Credential Manager because Windows Credential Manager only support saving tokens with less than 2.5KB blob size."
@@ -59,7 +64,10 @@ Expand-Archive -path $archiveFile -DestinationPath $tempdir
 
 Move-Item -Force (Join-Path $tempdir "docker-credential-acr-windows*.exe") $installLocation
 
-$configDir = Join-Path $env:UserProfile ".docker"
+$configDir = $env:DOCKER_CONFIG
+if (!$configDir) {
+    $configDir = Join-Path $env:UserProfile ".docker"
+}
 
 if (!(Test-Path $configDir)) {
     mkdir $configDir
@@ -67,16 +75,22 @@ if (!(Test-Path $configDir)) {
 
 $configFile = Join-Path $configDir "config.json"
 
-if (!(Test-Path $configFile)) {
-    $dummyConfigCreated = $true
-    Write-Output '{"auths":{}}' | Out-File $configFile -Encoding ASCII
-}
-
 $configEditPath = [System.IO.Path]::Combine(".", $tempdir, "config-edit.exe")
-&$configEditPath "--helper" "acr-windows" "--config-file" "${configFile}"
-
-if ($dummyConfigCreated) {
-    Remove-Item -Force "${configFile}.bak"
+if ($global) {
+    &$configEditPath "--helper" "acr-windows" "--config-file" "${configFile}"
+} else {
+    $suffixArgs = $registrySuffix | ForEach-Object { "--registry-suffix", $_ }
+    &$configEditPath "--helper" "acr-windows" "--scoped" @suffixArgs "--config-file" "${configFile}"
+    foreach ($server in $registry) {
+        &$configEditPath "--helper" "acr-windows" "--server" $server "--config-file" "${configFile}"
+    }
+    # docker login and az acr login only go through the helper for registries
+    # with a credHelpers entry, the others keep using credsStore
+    $credHelpers = &$configEditPath "get" "credHelpers" "--config-file" "${configFile}" 2>$null
+    if (!($credHelpers -match '"acr-windows"')) {
+        Write-Host "No registry in ${configFile} uses the ACR Credentials Helper yet, so logging in with 'az acr login' would bypass it."
+        Write-Host "Rerun this script with -registry <registry>.azurecr.io, or run 'config-edit --helper acr-windows --server <registry>.azurecr.io', before logging in."
+    }
 }
 
 if (!$skipCleanup) {
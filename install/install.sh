@@ -25,12 +25,21 @@ if [[ "$arch" -ne "amd64" ]]; then
     exit -1
 fi
 
-while getopts ":b:s:" opt; do
+## By default the helper is only set for the ACR registries found in the docker config,
+## -g sets it as the credsStore of all registries, -r adds the domain of other registries
+## and -n sets it for a registry that is not in the docker config yet
+while getopts ":b:s:gr:n:" opt; do
     case $opt in
         b) baseurl="$OPTARG"
         ;;
         s) skipCleanup="true"
         ;;
+        g) globalStore="true"
+        ;;
+        r) registrySuffixes+=("--registry-suffix" "$OPTARG")
+        ;;
+        n) registryServers+=("$OPTARG")
+        ;;
         \?) echo "Invalid option -$OPTARG" >&2
         ;;
     esac
@@ -88,23 +97,27 @@ fi
 ${sudoOption}cp ${tempdir}/docker-credential-acr-${os} ${installLocation}
 ${sudoOption}chmod +x ${installLocation}/docker-credential-acr-${os}
 
-configdir="$HOME/.docker"
+configdir="${DOCKER_CONFIG:-$HOME/.docker}"
 configFile="${configdir}/config.json"
 scriptRunner=`ls -ld $HOME | awk '{print $3}'`
 
 if [[ ! -d "${configdir}" ]]; then
-    mkdir ${configdir}
-fi
-
-if [[ ! -f "${configFile}" ]]; then
-    dummyConfigCreated="true"
-    echo "{\"auths\":{}}" >> ${configFile}
+    mkdir -p ${configdir}
 fi
 
-./${tempdir}/config-edit --helper acr-${os} --config-file ${configFile} --force
-
-if [[ ! -z "${dummyConfigCreated}" ]]; then
-    rm -f "${configFile}.bak"
+if [[ -n "$globalStore" ]]; then
+    ./${tempdir}/config-edit --helper acr-${os} --config-file ${configFile} --force
+else
+    ./${tempdir}/config-edit --helper acr-${os} --scoped "${registrySuffixes[@]}" --config-file ${configFile} --force
+    for server in "${registryServers[@]}"; do
+        ./${tempdir}/config-edit --helper acr-${os} --server "${server}" --config-file ${configFile} --force
+    done
+    ## docker login and az acr login only go through the helper for registries
+    ## with a credHelpers entry, the others keep using credsStore
+    if ! ./${tempdir}/config-edit get credHelpers --config-file ${configFile} 2>/dev/null | grep -q "\"acr-${os}\""; then
+        echo "No registry in ${configFile} uses the ACR Credentials Helper yet, so logging in with 'az acr login' would bypass it."
+        echo "Rerun this script with -n <registry>.azurecr.io, or run 'config-edit --helper acr-${os} --server <registry>.azurecr.io', before logging in."
+    fi
 fi
 
 if [[ -z "$skipCleanup" ]]; then
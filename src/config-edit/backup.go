@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	backupSuffix     = ".bak"
+	backupTimeFormat = "20060102T150405Z"
+	// latestBackup names the most recent backup for --restore
+	latestBackup = "latest"
+)
+
+// now is replaced in tests
+var now = time.Now
+
+// configBackup is a backup of a config file, named <config file>.<time>.bak
+// with a sequence number after the time when several backups are taken within
+// a second. The <config file>.bak of earlier versions has no time.
+type configBackup struct {
+	path     string
+	created  time.Time
+	sequence int
+}
+
+func (b configBackup) legacy() bool {
+	return b.created.IsZero()
+}
+
+// listBackups returns the backups of the config file, the most recent first
+func listBackups(configFile string) ([]configBackup, error) {
+	files, err := ioutil.ReadDir(filepath.Dir(configFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Error trying to list backups of %s, err: %s", configFile, err)
+	}
+	prefix := filepath.Base(configFile) + "."
+	var backups []configBackup
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		backup := configBackup{path: filepath.Join(filepath.Dir(configFile), name)}
+		if name != filepath.Base(configFile)+backupSuffix {
+			stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), backupSuffix)
+			if backup.created, backup.sequence, err = parseBackupStamp(stamp); err != nil {
+				continue
+			}
+		}
+		backups = append(backups, backup)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].legacy() != backups[j].legacy() {
+			return backups[j].legacy()
+		}
+		if !backups[i].created.Equal(backups[j].created) {
+			return backups[i].created.After(backups[j].created)
+		}
+		return backups[i].sequence > backups[j].sequence
+	})
+	return backups, nil
+}
+
+func parseBackupStamp(stamp string) (time.Time, int, error) {
+	sequence := 1
+	if dash := strings.LastIndex(stamp, "-"); dash != -1 {
+		var err error
+		if sequence, err = strconv.Atoi(stamp[dash+1:]); err != nil {
+			return time.Time{}, 0, err
+		}
+		stamp = stamp[:dash]
+	}
+	created, err := time.Parse(backupTimeFormat, stamp)
+	return created, sequence, err
+}
+
+// backupConfigFile moves the config file to a new backup, returning its path,
+// or an empty path when there is no config file yet
+func backupConfigFile(configFile string) (string, error) {
+	stamp := now().UTC().Format(backupTimeFormat)
+	backupFile := configFile + "." + stamp + backupSuffix
+	for sequence := 2; ; sequence++ {
+		if _, err := os.Stat(backupFile); os.IsNotExist(err) {
+			break
+		}
+		backupFile = fmt.Sprintf("%s.%s-%d%s", configFile, stamp, sequence, backupSuffix)
+	}
+	// NOTE: if any process created the same backup at this point by any chance, it would be overwritten
+	if err := os.Rename(configFile, backupFile); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return backupFile, nil
+}
+
+// pruneBackups removes the oldest backups beyond the number to keep, zero keeps
+// all of them. The backup of earlier versions is never removed since it may
+// hold the config from before the first edit.
+func pruneBackups(configFile string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	backups, err := listBackups(configFile)
+	if err != nil {
+		return err
+	}
+	kept := 0
+	for _, backup := range backups {
+		if backup.legacy() {
+			continue
+		}
+		if kept++; kept > keep {
+			if err = os.Remove(backup.path); err != nil {
+				return fmt.Errorf("Error trying to remove backup %s, err: %s", backup.path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// findBackup returns the backup with the file name or path, or the most
+// recent one for latest
+func findBackup(configFile string, name string) (configBackup, error) {
+	backups, err := listBackups(configFile)
+	if err != nil {
+		return configBackup{}, err
+	}
+	if len(backups) == 0 {
+		return configBackup{}, fmt.Errorf("There is no backup of %s", configFile)
+	}
+	if name == latestBackup {
+		return backups[0], nil
+	}
+	for _, backup := range backups {
+		if name == filepath.Base(backup.path) || filepath.Clean(name) == backup.path {
+			return backup, nil
+		}
+	}
+	return configBackup{}, fmt.Errorf("Unable to find backup %s of %s, see --list-backups", name, configFile)
+}
+
+func writeBackupList(out io.Writer, configFile string) error {
+	backups, err := listBackups(configFile)
+	if err != nil {
+		return err
+	}
+	if len(backups) == 0 {
+		_, err = fmt.Fprintf(out, "There is no backup of %s\n", configFile)
+		return err
+	}
+	table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "BACKUP\tCREATED")
+	for _, backup := range backups {
+		created := "-"
+		if !backup.legacy() {
+			created = backup.created.Format(time.RFC3339)
+		}
+		fmt.Fprintf(table, "%s\t%s\n", filepath.Base(backup.path), created)
+	}
+	return table.Flush()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotatingBackups(t *testing.T) {
+	force = true
+	defer func() { force = false }()
+	dir, err := ioutil.TempDir("", "config-edit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.json")
+	assert.NoError(t, ioutil.WriteFile(configFile+".bak", []byte(`{"legacy": true}`), 0600))
+
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := start
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	// the first edit creates the config file, the second and third back it up
+	// within the same second
+	for i, offset := range []time.Duration{0, time.Minute, time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		clock = start.Add(offset)
+		assert.NoError(t, writeConfigFile(configFile, []byte(fmt.Sprintf(`{"edit": %d}`, i)), 3))
+	}
+
+	backups, err := listBackups(configFile)
+	assert.NoError(t, err)
+	var names []string
+	for _, backup := range backups {
+		names = append(names, filepath.Base(backup.path))
+	}
+	assert.Equal(t, []string{
+		"config.json.20240301T120300Z.bak",
+		"config.json.20240301T120200Z.bak",
+		"config.json.20240301T120100Z-2.bak",
+		"config.json.bak",
+	}, names)
+
+	var out bytes.Buffer
+	assert.NoError(t, writeBackupList(&out, configFile))
+	assert.Contains(t, out.String(), "config.json.20240301T120300Z.bak    2024-03-01T12:03:00Z")
+	assert.Contains(t, out.String(), "config.json.bak                     -\n")
+
+	clock = start.Add(4 * time.Minute)
+	assert.NoError(t, restoreConfigFile(configFile, "config.json.20240301T120100Z-2.bak", 0))
+	restored, err := ioutil.ReadFile(configFile)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"edit": 1}`, string(restored))
+	latest, err := findBackup(configFile, latestBackup)
+	assert.NoError(t, err)
+	assert.Equal(t, configFile+".20240301T120400Z.bak", latest.path)
+
+	assert.NoError(t, restoreConfigFile(configFile, configFile+".bak", 0))
+	restored, err = ioutil.ReadFile(configFile)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"legacy": true}`, string(restored))
+
+	assert.Error(t, restoreConfigFile(configFile, "config.json.20200101T000000Z.bak", 0))
+}
+
+func TestUnchangedEditKeepsBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-edit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.json")
+	original := []byte(`{"auths": {"myregistry.azurecr.io": {}}}`)
+	assert.NoError(t, ioutil.WriteFile(configFile, original, 0600))
+
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := start
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	// only the first run edits the config file, the others find it up to date
+	for i := 0; i < 4; i++ {
+		clock = start.Add(time.Duration(i) * time.Minute)
+		output, err := runConfigEdit(configFile, "--helper", "helper0", "--keep-backups", "2")
+		assert.NoError(t, err)
+		if i > 0 {
+			assert.Equal(t, "Docker config "+configFile+" is already up to date\n", output)
+		}
+	}
+
+	backups, err := listBackups(configFile)
+	assert.NoError(t, err)
+	if assert.Len(t, backups, 1) {
+		assert.Equal(t, configFile+".20240301T120000Z.bak", backups[0].path)
+		content, err := ioutil.ReadFile(backups[0].path)
+		assert.NoError(t, err)
+		assert.Equal(t, original, content)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// diffLine is a line of a unified diff, op is ' ', '-' or '+'
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// unifiedDiff returns the changes from one content to the other in the
+// unified format of diff -u, or an empty string when they are equal
+func unifiedDiff(fromName string, toName string, from []byte, to []byte) string {
+	if bytes.Equal(from, to) {
+		return ""
+	}
+	lines := diffLines(splitLines(from), splitLines(to))
+
+	var output bytes.Buffer
+	fmt.Fprintf(&output, "--- %s\n+++ %s\n", fromName, toName)
+	// fromLine and toLine count the lines before index i of each side
+	fromLine, toLine := 0, 0
+	for i := 0; i < len(lines); {
+		if lines[i].op == ' ' {
+			fromLine++
+			toLine++
+			i++
+			continue
+		}
+		// a hunk starts with the context before the change and runs until
+		// the changes are more than twice the context apart
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for unchanged := 0; end < len(lines) && unchanged <= 2*diffContext; end++ {
+			if lines[end].op == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		for end > i && lines[end-1].op == ' ' {
+			end--
+		}
+		if end += diffContext; end > len(lines) {
+			end = len(lines)
+		}
+
+		fromStart, toStart := fromLine-(i-start), toLine-(i-start)
+		fromCount, toCount := 0, 0
+		for _, line := range lines[start:end] {
+			if line.op != '+' {
+				fromCount++
+			}
+			if line.op != '-' {
+				toCount++
+			}
+		}
+		fmt.Fprintf(&output, "@@ -%s +%s @@\n", hunkRange(fromStart, fromCount), hunkRange(toStart, toCount))
+		for _, line := range lines[start:end] {
+			output.WriteByte(line.op)
+			output.WriteString(line.text)
+			if !strings.HasSuffix(line.text, "\n") {
+				output.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		for _, line := range lines[i:end] {
+			if line.op != '+' {
+				fromLine++
+			}
+			if line.op != '-' {
+				toLine++
+			}
+		}
+		i = end
+	}
+	return output.String()
+}
+
+// hunkRange formats the range of a hunk from the count of lines before it
+func hunkRange(before int, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", before)
+	case 1:
+		return fmt.Sprintf("%d", before+1)
+	default:
+		return fmt.Sprintf("%d,%d", before+1, count)
+	}
+}
+
+// splitLines splits content into lines that keep their line endings
+func splitLines(content []byte) []string {
+	var lines []string
+	for len(content) > 0 {
+		end := bytes.IndexByte(content, '\n') + 1
+		if end == 0 {
+			end = len(content)
+		}
+		lines = append(lines, string(content[:end]))
+		content = content[end:]
+	}
+	return lines
+}
+
+// diffLines compares two lists of lines by their longest common subsequence
+func diffLines(from []string, to []string) []diffLine {
+	// common[i][j] is the length of the longest common subsequence of
+	// from[i:] and to[j:]
+	common := make([][]int, len(from)+1)
+	for i := range common {
+		common[i] = make([]int, len(to)+1)
+	}
+	for i := len(from) - 1; i >= 0; i-- {
+		for j := len(to) - 1; j >= 0; j-- {
+			if from[i] == to[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(from) || j < len(to) {
+		switch {
+		case i < len(from) && j < len(to) && from[i] == to[j]:
+			lines = append(lines, diffLine{' ', from[i]})
+			i++
+			j++
+		case j == len(to) || (i < len(from) && common[i+1][j] >= common[i][j+1]):
+			lines = append(lines, diffLine{'-', from[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', to[j]})
+			j++
+		}
+	}
+	return lines
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	from := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\nn\n"
+	to := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\nn\nadded"
+	expected := "--- old\n+++ new\n" +
+		"@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n" +
+		"@@ -12,3 +12,4 @@\n l\n m\n n\n+added\n\\ No newline at end of file\n"
+	assert.Equal(t, expected, unifiedDiff("old", "new", []byte(from), []byte(to)))
+
+	assert.Equal(t, "--- old\n+++ new\n@@ -0,0 +1 @@\n+{}\n", unifiedDiff("old", "new", nil, []byte("{}\n")))
+	assert.Equal(t, "--- old\n+++ new\n@@ -1,3 +1,2 @@\n a\n-b\n c\n", unifiedDiff("old", "new", []byte("a\nb\nc\n"), []byte("a\nc\n")))
+	assert.Empty(t, unifiedDiff("old", "new", []byte(from), []byte(from)))
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// configDocument is a JSON config file that is edited in place: every change
+// splices the new text into the original content, so members that are not
+// touched keep their order, indentation and line endings
+type configDocument struct {
+	content []byte
+	root    *jsonNode
+}
+
+// jsonNode is the span of a JSON value in the document, along with the members
+// of an object
+type jsonNode struct {
+	start    int
+	end      int
+	isObject bool
+	members  []jsonMember
+}
+
+// jsonMember is a member of an object, keyStart is the offset of the quoted key
+type jsonMember struct {
+	key      string
+	keyStart int
+	keyEnd   int
+	value    *jsonNode
+}
+
+func parseConfigDocument(content []byte) (*configDocument, error) {
+	var value interface{}
+	if err := json.Unmarshal(content, &value); err != nil {
+		return nil, err
+	}
+	if _, ok := value.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("the config is not a JSON object")
+	}
+	document := &configDocument{content: content}
+	return document, document.parse()
+}
+
+func (d *configDocument) bytes() []byte {
+	return d.content
+}
+
+func (d *configDocument) parse() error {
+	parser := &jsonParser{content: d.content}
+	root, err := parser.parseValue()
+	if err != nil {
+		return err
+	}
+	d.root = root
+	return nil
+}
+
+// get decodes the value at the path of member keys
+func (d *configDocument) get(path []string) (interface{}, bool, error) {
+	node, found, err := d.lookup(path)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	var value interface{}
+	if err = json.Unmarshal(d.content[node.start:node.end], &value); err != nil {
+		return nil, true, err
+	}
+	return value, true, nil
+}
+
+// set replaces the value at the path of member keys, adding the member and
+// any missing parent objects when it does not exist
+func (d *configDocument) set(path []string, value interface{}) error {
+	parent := d.root
+	for i, key := range path {
+		if !parent.isObject {
+			return fmt.Errorf("%s is not an object", strings.Join(path[:i], "."))
+		}
+		member := parent.member(key)
+		if member == nil {
+			for j := len(path) - 1; j > i; j-- {
+				value = map[string]interface{}{path[j]: value}
+			}
+			return d.insertMember(parent, key, value)
+		}
+		if i == len(path)-1 {
+			text, err := d.marshalValue(value, d.lineIndent(member.keyStart), d.isMultiline(parent))
+			if err != nil {
+				return err
+			}
+			return d.splice(member.value.start, member.value.end, text)
+		}
+		parent = member.value
+	}
+	return fmt.Errorf("Unable to replace the whole config")
+}
+
+// unset removes the member at the path of member keys, if it exists
+func (d *configDocument) unset(path []string) error {
+	if len(path) == 0 {
+		return fmt.Errorf("Unable to remove the whole config")
+	}
+	parent, found, err := d.lookup(path[:len(path)-1])
+	if err != nil || !found {
+		return err
+	}
+	if !parent.isObject {
+		return fmt.Errorf("%s is not an object", strings.Join(path[:len(path)-1], "."))
+	}
+	key := path[len(path)-1]
+	// encoding/json keeps the last of duplicate members, remove all of them
+	for index := parent.memberIndex(key); index != -1; index = parent.memberIndex(key) {
+		switch {
+		case len(parent.members) == 1:
+			err = d.splice(parent.start+1, parent.end-1, "")
+		case index < len(parent.members)-1:
+			err = d.splice(parent.members[index].keyStart, parent.members[index+1].keyStart, "")
+		default:
+			err = d.splice(parent.members[index-1].value.end, parent.members[index].value.end, "")
+		}
+		if err != nil {
+			return err
+		}
+		if parent, _, err = d.lookup(path[:len(path)-1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *configDocument) lookup(path []string) (*jsonNode, bool, error) {
+	node := d.root
+	for i, key := range path {
+		if !node.isObject {
+			return nil, false, fmt.Errorf("%s is not an object", strings.Join(path[:i], "."))
+		}
+		member := node.member(key)
+		if member == nil {
+			return nil, false, nil
+		}
+		node = member.value
+	}
+	return node, true, nil
+}
+
+// insertMember adds a member at the end of an object, indented like its
+// siblings or one level deeper than the object itself
+func (d *configDocument) insertMember(object *jsonNode, key string, value interface{}) error {
+	multiline := d.isMultiline(object)
+	var indent string
+	if len(object.members) > 0 {
+		indent = d.lineIndent(object.members[0].keyStart)
+	} else {
+		indent = d.lineIndent(object.start) + d.indentUnit()
+	}
+	keyText, err := marshalCompact(key)
+	if err != nil {
+		return err
+	}
+	valueText, err := d.marshalValue(value, indent, multiline)
+	if err != nil {
+		return err
+	}
+	member := keyText + d.keySeparator(object) + valueText
+
+	newline := d.newline()
+	switch {
+	case len(object.members) > 0 && multiline:
+		last := object.members[len(object.members)-1]
+		return d.splice(last.value.end, last.value.end, ","+newline+indent+member)
+	case len(object.members) > 0:
+		last := object.members[len(object.members)-1]
+		return d.splice(last.value.end, last.value.end, ","+d.inlineSpace(object)+member)
+	case multiline:
+		return d.splice(object.start, object.end, "{"+newline+indent+member+newline+d.lineIndent(object.start)+"}")
+	default:
+		return d.splice(object.start, object.end, "{"+member+"}")
+	}
+}
+
+// isMultiline tells whether the members of an object are on lines of their
+// own, empty objects follow the root object
+func (d *configDocument) isMultiline(object *jsonNode) bool {
+	if len(object.members) == 0 {
+		if object == d.root {
+			return true
+		}
+		return d.isMultiline(d.root)
+	}
+	return d.onOwnLine(object.members[0].keyStart)
+}
+
+// inlineSpace is the whitespace before the members of an inline object, such
+// as the space after the commas of {"a": 1, "b": 2}
+func (d *configDocument) inlineSpace(object *jsonNode) string {
+	if len(object.members) > 1 {
+		second := object.members[1].keyStart
+		comma := bytes.LastIndexByte(d.content[:second], ',')
+		return string(d.content[comma+1 : second])
+	}
+	return string(d.content[object.start+1 : object.members[0].keyStart])
+}
+
+// indentUnit is the indentation of one level, as used by the root object
+func (d *configDocument) indentUnit() string {
+	if len(d.root.members) > 0 && d.onOwnLine(d.root.members[0].keyStart) {
+		unit := strings.TrimPrefix(d.lineIndent(d.root.members[0].keyStart), d.lineIndent(d.root.start))
+		if unit != "" {
+			return unit
+		}
+	}
+	return "\t"
+}
+
+// keySeparator is the text between the keys and values of an object, such as
+// ": ", taken from the object itself or else from the root object
+func (d *configDocument) keySeparator(object *jsonNode) string {
+	for _, candidate := range []*jsonNode{object, d.root} {
+		if len(candidate.members) > 0 {
+			member := candidate.members[0]
+			return string(d.content[member.keyEnd:member.value.start])
+		}
+	}
+	return ": "
+}
+
+func (d *configDocument) newline() string {
+	if bytes.Contains(d.content, []byte("\r\n")) {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// lineIndent returns the whitespace at the start of the line holding offset
+func (d *configDocument) lineIndent(offset int) string {
+	lineStart := bytes.LastIndexByte(d.content[:offset], '\n') + 1
+	end := lineStart
+	for end < offset && (d.content[end] == ' ' || d.content[end] == '\t') {
+		end++
+	}
+	return string(d.content[lineStart:end])
+}
+
+func (d *configDocument) onOwnLine(offset int) bool {
+	lineStart := bytes.LastIndexByte(d.content[:offset], '\n') + 1
+	return len(bytes.TrimSpace(d.content[lineStart:offset])) == 0 && lineStart > 0
+}
+
+// marshalValue formats a value to be placed at the indentation of its member
+func (d *configDocument) marshalValue(value interface{}, indent string, multiline bool) (string, error) {
+	if !multiline {
+		return marshalCompact(value)
+	}
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent(indent, d.indentUnit())
+	if err := encoder.Encode(value); err != nil {
+		return "", err
+	}
+	text := strings.TrimSuffix(buffer.String(), "\n")
+	if newline := d.newline(); newline != "\n" {
+		text = strings.Replace(text, "\n", newline, -1)
+	}
+	return text, nil
+}
+
+func marshalCompact(value interface{}) (string, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buffer.String(), "\n"), nil
+}
+
+// splice replaces the content from start to end and parses the result
+func (d *configDocument) splice(start int, end int, text string) error {
+	content := make([]byte, 0, len(d.content)-(end-start)+len(text))
+	content = append(content, d.content[:start]...)
+	content = append(content, text...)
+	d.content = append(content, d.content[end:]...)
+	return d.parse()
+}
+
+// member returns the last member with the key, as encoding/json would
+func (n *jsonNode) member(key string) *jsonMember {
+	if index := n.memberIndex(key); index != -1 {
+		return &n.members[index]
+	}
+	return nil
+}
+
+func (n *jsonNode) memberIndex(key string) int {
+	for i := len(n.members) - 1; i >= 0; i-- {
+		if n.members[i].key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// jsonParser records the spans of the values of a document that is known to
+// be valid JSON
+type jsonParser struct {
+	content []byte
+	pos     int
+}
+
+func (p *jsonParser) skipSpace() {
+	for p.pos < len(p.content) {
+		switch p.content[p.pos] {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *jsonParser) parseValue() (*jsonNode, error) {
+	p.skipSpace()
+	if p.pos >= len(p.content) {
+		return nil, fmt.Errorf("unexpected end of JSON input")
+	}
+	node := &jsonNode{start: p.pos}
+	switch p.content[p.pos] {
+	case '{':
+		node.isObject = true
+		p.pos++
+		for {
+			p.skipSpace()
+			if p.pos < len(p.content) && p.content[p.pos] == '}' {
+				break
+			}
+			if p.pos < len(p.content) && p.content[p.pos] == ',' {
+				p.pos++
+				p.skipSpace()
+			}
+			member := jsonMember{keyStart: p.pos}
+			if err := p.skipString(); err != nil {
+				return nil, err
+			}
+			member.keyEnd = p.pos
+			if err := json.Unmarshal(p.content[member.keyStart:member.keyEnd], &member.key); err != nil {
+				return nil, err
+			}
+			p.skipSpace()
+			p.pos++ // colon
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			member.value = value
+			node.members = append(node.members, member)
+		}
+		p.pos++
+	case '[':
+		p.pos++
+		for {
+			p.skipSpace()
+			if p.pos < len(p.content) && p.content[p.pos] == ']' {
+				break
+			}
+			if p.pos < len(p.content) && p.content[p.pos] == ',' {
+				p.pos++
+			}
+			if _, err := p.parseValue(); err != nil {
+				return nil, err
+			}
+		}
+		p.pos++
+	case '"':
+		if err := p.skipString(); err != nil {
+			return nil, err
+		}
+	default:
+		for p.pos < len(p.content) && !strings.ContainsRune(" \t\r\n,]}", rune(p.content[p.pos])) {
+			p.pos++
+		}
+	}
+	node.end = p.pos
+	return node, nil
+}
+
+func (p *jsonParser) skipString() error {
+	if p.pos >= len(p.content) || p.content[p.pos] != '"' {
+		return fmt.Errorf("expected a string at offset %d", p.pos)
+	}
+	for p.pos++; p.pos < len(p.content); p.pos++ {
+		switch p.content[p.pos] {
+		case '\\':
+			p.pos++
+		case '"':
+			p.pos++
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected end of JSON input")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+)
+
+const pathHelp = "The path names nested keys separated by dots, such as proxies.default.httpProxy. " +
+	"Registry names may be given as they are, as in credHelpers.myregistry.azurecr.io, " +
+	"and a dot that is part of any other key is escaped as \\."
+
+func newGetCommand(options *editOptions, out io.Writer) *cobra.Command {
+	return &cobra.Command{
+		Use:   "get <path>",
+		Short: "Print the value at a path of the config file.",
+		Long:  "Print the value at a path of the config file, strings as they are and other values as JSON. " + pathHelp,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configFile, target, err := resolveConfigFile(options.targetName, options.configFile, options.configDir)
+			if err != nil {
+				return err
+			}
+			keys, _, err := resolveConfigPath(target, args[0])
+			if err != nil {
+				return err
+			}
+			content, err := readConfigFile(configFile)
+			if err != nil {
+				return err
+			}
+			configObj, err := parseConfigObject(configFile, content)
+			if err != nil {
+				return err
+			}
+			value, found, err := configObj.get(keys)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return fmt.Errorf("%s is not set in %s", args[0], configFile)
+			}
+			return writeValue(out, value)
+		},
+	}
+}
+
+func newSetCommand(options *editOptions, out io.Writer) *cobra.Command {
+	return &cobra.Command{
+		Use:   "set <path> <value>",
+		Short: "Set the value at a path of the config file.",
+		Long: "Set the value at a path of the config file. Values of known keys are checked against the config " +
+			"schema, strings are taken as they are and objects or arrays are given as JSON. Values of unknown keys " +
+			"are read as JSON when valid, otherwise as strings. " + pathHelp,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configFile, target, err := resolveConfigFile(options.targetName, options.configFile, options.configDir)
+			if err != nil {
+				return err
+			}
+			keys, schema, err := resolveConfigPath(target, args[0])
+			if err != nil {
+				return err
+			}
+			value, err := schema.parseValue(args[0], args[1])
+			if err != nil {
+				return err
+			}
+			return options.apply(out, configFile, func(configObj *configDocument) error {
+				return configObj.set(keys, value)
+			})
+		},
+	}
+}
+
+func newUnsetCommand(options *editOptions, out io.Writer) *cobra.Command {
+	return &cobra.Command{
+		Use:   "unset <path>",
+		Short: "Remove the value at a path of the config file.",
+		Long: "Remove the value at a path of the config file, along with a map such as credHelpers that is left " +
+			"empty. Removing a value that is not set leaves the config file unchanged. " + pathHelp,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configFile, target, err := resolveConfigFile(options.targetName, options.configFile, options.configDir)
+			if err != nil {
+				return err
+			}
+			keys, _, err := resolveConfigPath(target, args[0])
+			if err != nil {
+				return err
+			}
+			return options.apply(out, configFile, func(configObj *configDocument) error {
+				return unsetConfigPath(configObj, target.schema, keys)
+			})
+		},
+	}
+}
+
+// resolveConfigPath returns the member keys of a path along with the schema of
+// its value
+func resolveConfigPath(target configTarget, path string) ([]string, *schemaNode, error) {
+	keys, err := splitConfigPath(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return target.schema.resolve(keys)
+}
+
+// unsetConfigPath removes the value at the keys, along with the known map that
+// held it when it is left empty
+func unsetConfigPath(configObj *configDocument, schema *schemaNode, keys []string) error {
+	if err := configObj.unset(keys); err != nil {
+		return err
+	}
+	if len(keys) < 2 {
+		return nil
+	}
+	parentKeys := keys[:len(keys)-1]
+	_, parentSchema, err := schema.resolve(parentKeys)
+	if err != nil || parentSchema.kind != mapKind {
+		return err
+	}
+	parent, found, err := configObj.get(parentKeys)
+	if err != nil || !found {
+		return err
+	}
+	if members, ok := parent.(map[string]interface{}); ok && len(members) == 0 {
+		return configObj.unset(parentKeys)
+	}
+	return nil
+}
+
+// writeValue prints strings as they are and other values as indented JSON
+func writeValue(out io.Writer, value interface{}) error {
+	if text, ok := value.(string); ok {
+		_, err := fmt.Fprintln(out, text)
+		return err
+	}
+	text, err := json.MarshalIndent(value, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, string(text))
+	return err
+}
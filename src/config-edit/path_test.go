@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigPathCommands(t *testing.T) {
+	testCases := []struct {
+		baseline string
+		action   string
+		args     []string
+	}{
+		{
+			baseline: "formatted",
+			action:   "set_proxy",
+			args:     []string{"set", "proxies.default.httpsProxy", "https://proxy.example.com:3129"},
+		},
+		{
+			baseline: "formatted",
+			action:   "set_auth_placeholder",
+			args:     []string{"set", "auths.myregistry.azurecr.io", "{}"},
+		},
+		{
+			baseline: "formatted",
+			action:   "set_detachkeys",
+			args:     []string{"set", "detachKeys", "ctrl-x,x"},
+		},
+		{
+			baseline: "formatted",
+			action:   "set_context",
+			args:     []string{"set", "currentContext", "remote"},
+		},
+		{
+			baseline: "formatted",
+			action:   "set_helper",
+			args:     []string{"set", "credHelpers.myregistry.azurecr.io", "acr-linux"},
+		},
+		{
+			baseline: "formatted",
+			action:   "set_unknown",
+			args:     []string{"set", "myTool", `{"enabled": true}`},
+		},
+		{
+			baseline: "formatted",
+			action:   "unset_helper",
+			args:     []string{"unset", "credHelpers.gcr.io"},
+		},
+		{
+			baseline: "formatted",
+			action:   "unset_helper",
+			args:     []string{"unset", `credHelpers.gcr\.io`},
+		},
+		{
+			baseline: "formatted.set_helper",
+			action:   "unset_stale_helper",
+			args:     []string{"unset", "credHelpers.gcr.io"},
+		},
+	}
+	dir, err := ioutil.TempDir("", "config-edit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for _, tc := range testCases {
+		name := fmt.Sprintf("%s.%s", tc.baseline, tc.action)
+		configFile := filepath.Join(dir, "config.json")
+		original, err := ioutil.ReadFile(fmt.Sprintf("./testcase/%s.config.json", tc.baseline))
+		assert.NoError(t, err, name)
+		assert.NoError(t, ioutil.WriteFile(configFile, original, 0600), name)
+
+		_, err = runConfigEdit(configFile, append(tc.args, "--keep-backups", "0")...)
+		assert.NoError(t, err, name)
+		expected, err := ioutil.ReadFile(fmt.Sprintf("./testcase/%s.config.json", name))
+		assert.NoError(t, err, name)
+		actual, err := ioutil.ReadFile(configFile)
+		assert.NoError(t, err, name)
+		assert.Equal(t, string(expected), string(actual), name)
+	}
+}
+
+func TestConfigPathValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-edit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.json")
+	original, err := ioutil.ReadFile("./testcase/formatted.config.json")
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(configFile, original, 0600))
+
+	output, err := runConfigEdit(configFile, "get", "detachKeys")
+	assert.NoError(t, err)
+	assert.Equal(t, "ctrl-e,e\n", output)
+	output, err = runConfigEdit(configFile, "get", "credHelpers.gcr.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "gcloud\n", output)
+	output, err = runConfigEdit(configFile, "get", "proxies.default")
+	assert.NoError(t, err)
+	assert.Equal(t, "{\n\t\"httpProxy\": \"http://proxy.example.com:3128\"\n}\n", output)
+	_, err = runConfigEdit(configFile, "get", "currentContext")
+	assert.Error(t, err)
+
+	for _, args := range [][]string{
+		{"set", "detachKeys.keys", "ctrl-x,x"},
+		{"set", "proxies", "[]"},
+		{"set", "proxies.default", `{"httpProxy": 3128}`},
+		{"set", "auths", "{"},
+		{"set", "cliPluginsExtraDirs", `["/opt/plugins", 1]`},
+		{"set", "proxies..httpProxy", "http://proxy.example.com:3128"},
+		{"unset", "credsStore.helper"},
+	} {
+		_, err = runConfigEdit(configFile, args...)
+		assert.Error(t, err, "%v", args)
+	}
+
+	_, err = runConfigEdit(configFile, "unset", "currentContext")
+	assert.NoError(t, err)
+	edited, err := ioutil.ReadFile(configFile)
+	assert.NoError(t, err)
+	assert.Equal(t, original, edited)
+}
+
+func TestSplitConfigPath(t *testing.T) {
+	keys, err := splitConfigPath(`proxies.default.httpProxy`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"proxies", "default", "httpProxy"}, keys)
+	keys, err = splitConfigPath(`plugins.my\.plugin.key\\`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"plugins", "my.plugin", `key\`}, keys)
+
+	keys, _, err = dockerSchema.resolve([]string{"auths", "myregistry", "azurecr", "io", "identitytoken"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"auths", "myregistry.azurecr.io", "identitytoken"}, keys)
+	keys, _, err = dockerSchema.resolve([]string{"plugins", "my", "plugin", "key"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"plugins", "my", "plugin.key"}, keys)
+	_, _, err = dockerSchema.resolve([]string{"credsStore", "helper"})
+	assert.Error(t, err)
+}
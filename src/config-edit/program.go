@@ -1,11 +1,12 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
-	"path"
+	"path/filepath"
 	"runtime"
 	"strings"
 
@@ -15,118 +16,288 @@ import (
 var force bool
 
 func main() {
-	var configFile, helper, server string
+	// the banner goes to stderr so that the output of get can be captured
+	fmt.Fprintln(os.Stderr, "Runing ACR docker config editor...")
+
+	// the command is silenced, so that its error is printed here once
+	if err := newEditCommand(os.Stdout).Execute(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error running subcommand: %s\n", err)
+		os.Exit(-1)
+	}
+}
+
+// editOptions are the options shared by the config editor and its get, set
+// and unset commands
+type editOptions struct {
+	configFile  string
+	configDir   string
+	targetName  string
+	dryRun      bool
+	check       bool
+	keepBackups int
+}
+
+// newEditCommand returns the config editor command, which prints the diffs of
+// --dry-run and the values read by get to out
+func newEditCommand(out io.Writer) *cobra.Command {
+	var helper, server, restore string
+	var unset, scoped, listBackups bool
+	var registrySuffixes []string
+	options := &editOptions{}
 	cmd := &cobra.Command{
 		Use:   "Docker Login Config Editor",
 		Short: "Configure docker to use different helper for login.",
-		Long:  "Configure docker to use different helper for login.",
+		Long: "Configure docker to use different helper for login. The config files of podman, skopeo and buildah " +
+			"or of Helm can be edited instead with --target, as they share the credHelpers layout.",
+		// errors are printed once by main, and a failed --check is no usage error
+		SilenceErrors: true,
+		SilenceUsage:  true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if len(configFile) == 0 {
-				configFile = path.Join(userHomeDir(), ".docker", "config.json")
+			configFile, target, err := resolveConfigFile(options.targetName, options.configFile, options.configDir)
+			if err != nil {
+				return err
+			}
+			if listBackups {
+				return writeBackupList(out, configFile)
 			}
-			if len(helper) == 0 {
+			if len(restore) != 0 {
+				if options.dryRun || options.check {
+					return fmt.Errorf("Please specify either --restore or --dry-run and --check")
+				}
+				return restoreConfigFile(configFile, restore, options.keepBackups)
+			}
+			if !unset && len(helper) == 0 {
 				return fmt.Errorf("Please specify a helper name")
 			}
-
-			var err error
-			var configObj *map[string]interface{}
-			if configObj, err = loadConfigObject(configFile); err != nil {
-				return err
+			if unset && len(helper) != 0 {
+				return fmt.Errorf("Please specify either a helper name or --unset")
 			}
-
-			err = editConfigObject(configObj, server, helper)
-			if err != nil {
-				return err
+			if scoped && (unset || len(server) != 0) {
+				return fmt.Errorf("Please specify either --scoped or --server and --unset")
 			}
-
-			var bytes []byte
-			if bytes, err = json.MarshalIndent(configObj, "", "\t"); err != nil {
-				return fmt.Errorf("Error trying to marshal config object, err: %s", err)
+			if len(registrySuffixes) != 0 && !scoped {
+				return fmt.Errorf("--registry-suffix only applies to --scoped")
 			}
-
-			var bakFileName = configFile + ".bak"
-			if _, err = os.Stat(bakFileName); err == nil || !os.IsNotExist(err) {
-				if err = promptForAbort("Please note that bak file will be overwritten, continue?"); err != nil {
-					return err
-				}
+			if !target.credsStore && !scoped && len(server) == 0 {
+				return fmt.Errorf("The %s config only supports helpers per registry, please specify a server", options.targetName)
 			}
 
-			// NOTE: if any process created a bak file at this point by any chance, it would be overwritten
-			if err = os.Rename(configFile, bakFileName); err != nil && !os.IsNotExist(err) {
-				if err = promptForAbort("Unable to back up config file, continue?"); err != nil {
+			var hosts []string
+			err = options.apply(out, configFile, func(configObj *configDocument) (err error) {
+				switch {
+				case unset:
+					return unsetConfigObject(configObj, server)
+				case scoped:
+					hosts, err = scopeConfigObject(configObj, helper, registrySuffixes)
 					return err
+				default:
+					return editConfigObject(configObj, server, helper)
 				}
+			})
+			if err == nil && scoped && len(hosts) == 0 {
+				fmt.Fprintf(out, "No ACR registries were found in %s, please specify a server to add one\n", configFile)
 			}
-
-			fmt.Printf("Docker config %s will be edited\n", configFile)
-			if err = ioutil.WriteFile(configFile, bytes, 0644); err != nil {
-				return fmt.Errorf("Error trying to write file to location %s, err: %s", configFile, err)
-			}
-
-			return nil
+			return err
 		},
 	}
 
-	fmt.Println("Runing ACR docker config editor...")
-
 	flags := cmd.Flags()
-	flags.StringVar(&configFile, "config-file", "", "Location of the config file.")
 	flags.StringVar(&helper, "helper", "", "Name of the login helper to be used.")
 	flags.StringVar(&server, "server", "", "Docker registry url to use this helper.")
-	flags.BoolVar(&force, "force", false, "Silently continue on warnings")
+	flags.BoolVar(&scoped, "scoped", false, "Set the helper for the ACR registries found in auths and credHelpers only, leaving credsStore untouched.")
+	flags.StringSliceVar(&registrySuffixes, "registry-suffix", nil, "Domain of other registries to include with --scoped, besides azurecr.io, azurecr.cn, azurecr.us and azurecr.de.")
+	flags.BoolVar(&unset, "unset", false, "Remove the credsStore, or the credHelpers entry of --server, instead of setting a helper.")
+	flags.StringVar(&restore, "restore", "", "Replace the config file with a backup, the latest one or the one given as --restore=<backup>.")
+	flags.Lookup("restore").NoOptDefVal = latestBackup
+	flags.BoolVar(&listBackups, "list-backups", false, "List the backups of the config file, the latest first.")
 
-	cmd.MarkFlagRequired("helper")
+	persistentFlags := cmd.PersistentFlags()
+	persistentFlags.StringVar(&options.configFile, "config-file", "", "Location of the config file.")
+	persistentFlags.StringVar(&options.configDir, "config", "", "Location of the docker config directory, defaults to DOCKER_CONFIG or .docker in the home directory.")
+	persistentFlags.StringVar(&options.targetName, "target", "docker", "Tool whose config file is edited: docker, containers for podman, skopeo and buildah, or helm.")
+	persistentFlags.IntVar(&options.keepBackups, "keep-backups", 10, "Number of backups of the config file to keep, 0 keeps all of them.")
+	persistentFlags.BoolVar(&options.dryRun, "dry-run", false, "Print the changes as a unified diff without editing the config file.")
+	persistentFlags.BoolVar(&options.check, "check", false, "Fail when the config file would be changed, without editing it.")
+	persistentFlags.BoolVar(&force, "force", false, "Silently continue on warnings")
 
-	if err := cmd.Execute(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error running subcommand: %s\n", err)
-		os.Exit(-1)
+	cmd.AddCommand(newGetCommand(options, out))
+	cmd.AddCommand(newSetCommand(options, out))
+	cmd.AddCommand(newUnsetCommand(options, out))
+	return cmd
+}
+
+// apply edits the config file and writes it. With --dry-run the changes are
+// only printed, and with --check it fails when there are changes. A config
+// file that is already in the desired state is neither written nor backed up,
+// so that repeated runs do not rotate out the backups of earlier edits.
+func (o *editOptions) apply(out io.Writer, configFile string, edit func(configObj *configDocument) error) error {
+	original, err := readConfigFile(configFile)
+	if err != nil {
+		return err
+	}
+	configObj, err := parseConfigObject(configFile, original)
+	if err != nil {
+		return err
+	}
+	if err = edit(configObj); err != nil {
+		return err
+	}
+
+	if o.dryRun {
+		fmt.Fprint(out, unifiedDiff(configFile, configFile, original, configObj.bytes()))
+	}
+	if o.check && !bytes.Equal(original, configObj.bytes()) {
+		return fmt.Errorf("Docker config %s is not in the desired state", configFile)
+	}
+	if o.dryRun || o.check {
+		return nil
+	}
+	if bytes.Equal(original, configObj.bytes()) {
+		fmt.Fprintf(out, "Docker config %s is already up to date\n", configFile)
+		return nil
 	}
+	return writeConfigFile(configFile, configObj.bytes(), o.keepBackups)
 }
 
-func loadConfigObject(configFile string) (configObj *map[string]interface{}, err error) {
+func loadConfigObject(configFile string) (*configDocument, error) {
+	content, err := readConfigFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfigObject(configFile, content)
+}
+
+// readConfigFile returns the content of the config file, nil when it does not exist
+func readConfigFile(configFile string) (content []byte, err error) {
 	if _, err = os.Stat(configFile); err != nil {
 		if os.IsNotExist(err) {
-			configObj = &map[string]interface{}{}
-		} else {
-			return nil, fmt.Errorf("Error trying to access config file: %s, err: %s", configFile, err)
-		}
-	} else {
-		var bytes []byte
-		if bytes, err = ioutil.ReadFile(configFile); err != nil {
-			return nil, fmt.Errorf("Error trying to read config file %s, err: %s", configFile, err)
-		}
-		if err = json.Unmarshal(bytes, &configObj); err != nil {
-			return nil, fmt.Errorf("Error trying to unmarshal config file %s, err: %s", configFile, err)
+			return nil, nil
 		}
+		return nil, fmt.Errorf("Error trying to access config file: %s, err: %s", configFile, err)
 	}
-	return configObj, err
+	if content, err = ioutil.ReadFile(configFile); err != nil {
+		return nil, fmt.Errorf("Error trying to read config file %s, err: %s", configFile, err)
+	}
+	return content, nil
+}
+
+// parseConfigObject parses the content of the config file, an empty object when
+// the file does not exist
+func parseConfigObject(configFile string, content []byte) (configObj *configDocument, err error) {
+	if content == nil {
+		content = []byte("{}")
+	}
+	if configObj, err = parseConfigDocument(content); err != nil {
+		return nil, fmt.Errorf("Error trying to unmarshal config file %s, err: %s", configFile, err)
+	}
+	return configObj, nil
 }
 
-func editConfigObject(configObj *map[string]interface{}, server string, helper string) error {
+func editConfigObject(configObj *configDocument, server string, helper string) error {
 	if len(server) == 0 {
 		// edit credsStore element
-		(*configObj)["credsStore"] = helper
-	} else {
-		// edit credHelpers element
-		helperMapObj, exists := (*configObj)["credHelpers"]
-		helperMap := make(map[string]string)
-		if exists {
-			oldMap, ok := helperMapObj.(map[string]interface{})
-			if !ok {
-				return fmt.Errorf("Error parsing old credHelpers")
-			}
-			for k, v := range oldMap {
-				value, ok := v.(string)
-				if !ok {
-					return fmt.Errorf("Error parsing old credHelpers value")
-				}
-				helperMap[k] = value
-			}
+		return configObj.set([]string{"credsStore"}, helper)
+	}
+	// edit credHelpers element
+	if _, err := credHelpersOf(configObj); err != nil {
+		return err
+	}
+	return configObj.set([]string{"credHelpers", server}, helper)
+}
+
+// unsetConfigObject removes the credsStore element, or the credHelpers entry of
+// the server, along with a credHelpers element left empty
+func unsetConfigObject(configObj *configDocument, server string) error {
+	if len(server) == 0 {
+		if err := configObj.unset([]string{"credsStore"}); err != nil {
+			return err
+		}
+	}
+	helperMap, err := credHelpersOf(configObj)
+	if err != nil || helperMap == nil {
+		return err
+	}
+	if len(server) != 0 {
+		if err = configObj.unset([]string{"credHelpers", server}); err != nil {
+			return err
+		}
+		delete(helperMap, server)
+	}
+	if len(helperMap) == 0 {
+		return configObj.unset([]string{"credHelpers"})
+	}
+	return nil
+}
+
+// credHelpersOf returns the credHelpers element, nil when there is none
+func credHelpersOf(configObj *configDocument) (map[string]string, error) {
+	helperMapObj, exists, err := configObj.get([]string{"credHelpers"})
+	if err != nil || !exists {
+		return nil, err
+	}
+	oldMap, ok := helperMapObj.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Error parsing old credHelpers")
+	}
+	helperMap := make(map[string]string)
+	for k, v := range oldMap {
+		value, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("Error parsing old credHelpers value")
 		}
-		(*configObj)["credHelpers"] = helperMap
-		helperMap[server] = helper
+		helperMap[k] = value
+	}
+	return helperMap, nil
+}
+
+// writeConfigFile moves the config file to a new backup and writes the
+// content in its place, keeping as many backups as given
+func writeConfigFile(configFile string, content []byte, keepBackups int) error {
+	// keep the permissions of the config file, which may hold credentials
+	var mode os.FileMode = 0600
+	if fileInfo, err := os.Stat(configFile); err == nil {
+		mode = fileInfo.Mode().Perm()
+	}
+
+	backupFile, err := backupConfigFile(configFile)
+	if err != nil {
+		if err = promptForAbort("Unable to back up config file, continue?"); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Docker config %s will be edited\n", configFile)
+	if len(backupFile) != 0 {
+		fmt.Printf("The previous config is backed up to %s\n", backupFile)
+	}
+	if err = os.MkdirAll(filepath.Dir(configFile), 0700); err != nil {
+		return fmt.Errorf("Error trying to create the directory of %s, err: %s", configFile, err)
 	}
+	if err = ioutil.WriteFile(configFile, content, mode); err != nil {
+		return fmt.Errorf("Error trying to write file to location %s, err: %s", configFile, err)
+	}
+
+	return pruneBackups(configFile, keepBackups)
+}
 
+// restoreConfigFile replaces the config file with the content of one of its
+// backups, the config file itself is backed up first
+func restoreConfigFile(configFile string, name string, keepBackups int) error {
+	backup, err := findBackup(configFile, name)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(backup.path)
+	if err != nil {
+		return fmt.Errorf("Error trying to read backup file %s, err: %s", backup.path, err)
+	}
+	if err = promptForAbort(fmt.Sprintf("Docker config %s will be replaced by its backup %s, continue?", configFile, backup.path)); err != nil {
+		return err
+	}
+	if err = writeConfigFile(configFile, content, keepBackups); err != nil {
+		return err
+	}
+	fmt.Printf("Docker config %s was restored from %s\n", configFile, backup.path)
 	return nil
 }
 
@@ -147,6 +318,19 @@ func promptForAbort(msg string) error {
 	return nil
 }
 
+// dockerConfigDir returns the docker config directory the way the docker CLI
+// resolves it: the --config option, then DOCKER_CONFIG, then .docker in the
+// home directory
+func dockerConfigDir(configDir string) string {
+	if len(configDir) != 0 {
+		return configDir
+	}
+	if configDir = os.Getenv("DOCKER_CONFIG"); len(configDir) != 0 {
+		return configDir
+	}
+	return filepath.Join(userHomeDir(), ".docker")
+}
+
 func userHomeDir() string {
 	if runtime.GOOS == "windows" {
 		home := os.Getenv("HOMEDRIVE") + os.Getenv("HOMEPATH")
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -14,6 +18,7 @@ func TestEditConfigObject(t *testing.T) {
 		action   string
 		server   string
 		helper   string
+		unset    bool
 	}{
 		{
 			baseline: "none",
@@ -60,16 +65,49 @@ func TestEditConfigObject(t *testing.T) {
 			server:   "server1",
 			helper:   "helper1",
 		},
+		{
+			baseline: "credstore",
+			action:   "unset_credstore",
+			unset:    true,
+		},
+		{
+			baseline: "helpers_empty",
+			action:   "unset_credstore",
+			unset:    true,
+		},
+		{
+			baseline: "helpers_existing",
+			action:   "unset_helper",
+			server:   "server1",
+			unset:    true,
+		},
+		{
+			baseline: "helpers_multiple",
+			action:   "unset_helper",
+			server:   "server2",
+			unset:    true,
+		},
+		{
+			baseline: "none",
+			action:   "unset_helper",
+			server:   "server1",
+			unset:    true,
+		},
 	}
 	for iteration, tc := range testCases {
 		fmt.Printf("Running iteration %d...\n", iteration)
 		var err error
-		var actual, expected *map[string]interface{}
+		var actual, expected *configDocument
 		actual, err = loadConfigObject(fmt.Sprintf("./testcase/%s.config.json", tc.baseline))
 		if err != nil {
 			assert.Fail(t, fmt.Sprintf("ERROR: %s", err.Error()))
 		}
-		editConfigObject(actual, tc.server, tc.helper)
+		if tc.unset {
+			err = unsetConfigObject(actual, tc.server)
+		} else {
+			err = editConfigObject(actual, tc.server, tc.helper)
+		}
+		assert.NoError(t, err)
 		expected, err = loadConfigObject(fmt.Sprintf("./testcase/%s.%s.config.json", tc.baseline, tc.action))
 		if err != nil {
 			assert.Fail(t, fmt.Sprintf("ERROR: %s", err.Error()))
@@ -83,14 +121,222 @@ func TestEditConfigObject(t *testing.T) {
 		if err != nil {
 			assert.Fail(t, fmt.Sprintf("ERROR: %s", err.Error()))
 		}
-		// well, we are counting on the order of properties being serialized being consistent
+		// the documents are compared by content, encoding/json sorts the keys of maps
 		assert.Equal(t, expectedStr, actualStr)
 	}
 }
 
-func toString(obj *map[string]interface{}) (output string, err error) {
+func TestRestoreConfigFile(t *testing.T) {
+	force = true
+	defer func() { force = false }()
+	dir, err := ioutil.TempDir("", "config-edit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.json")
+
+	assert.Error(t, restoreConfigFile(configFile, latestBackup, 10))
+
+	original, err := ioutil.ReadFile("./testcase/credstore.config.json")
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(configFile, original, 0644))
+	configObj, err := loadConfigObject(configFile)
+	assert.NoError(t, err)
+	assert.NoError(t, unsetConfigObject(configObj, ""))
+	assert.NoError(t, writeConfigFile(configFile, configObj.bytes(), 10))
+	edited, err := ioutil.ReadFile(configFile)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(edited), "credsStore")
+
+	assert.NoError(t, restoreConfigFile(configFile, latestBackup, 10))
+	restored, err := ioutil.ReadFile(configFile)
+	assert.NoError(t, err)
+	assert.Equal(t, original, restored)
+	backups, err := listBackups(configFile)
+	assert.NoError(t, err)
+	if assert.Len(t, backups, 2) {
+		latest, err := ioutil.ReadFile(backups[0].path)
+		assert.NoError(t, err)
+		assert.Equal(t, edited, latest)
+	}
+}
+
+func TestEditConfigPreservesFormatting(t *testing.T) {
+	testCases := []struct {
+		baseline string
+		action   string
+		server   string
+		helper   string
+		unset    bool
+	}{
+		{
+			baseline: "formatted",
+			action:   "added_credstore",
+			helper:   "helper0",
+		},
+		{
+			baseline: "formatted",
+			action:   "added_helper",
+			server:   "server1",
+			helper:   "helper1",
+		},
+		{
+			baseline: "formatted",
+			action:   "changed_helper",
+			server:   "gcr.io",
+			helper:   "helper1",
+		},
+		{
+			baseline: "formatted",
+			action:   "unset_helper",
+			server:   "gcr.io",
+			unset:    true,
+		},
+		{
+			baseline: "compact",
+			action:   "added_credstore",
+			helper:   "helper0",
+		},
+		{
+			baseline: "compact",
+			action:   "added_helper",
+			server:   "server1",
+			helper:   "helper1",
+		},
+		{
+			baseline: "credstore",
+			action:   "added_helper_verbatim",
+			server:   "server1",
+			helper:   "helper1",
+		},
+		{
+			baseline: "credstore",
+			action:   "unset_credstore_verbatim",
+			unset:    true,
+		},
+	}
+	for _, tc := range testCases {
+		name := fmt.Sprintf("%s.%s", tc.baseline, tc.action)
+		actual, err := loadConfigObject(fmt.Sprintf("./testcase/%s.config.json", tc.baseline))
+		assert.NoError(t, err, name)
+		if tc.unset {
+			err = unsetConfigObject(actual, tc.server)
+		} else {
+			err = editConfigObject(actual, tc.server, tc.helper)
+		}
+		assert.NoError(t, err, name)
+		expected, err := ioutil.ReadFile(fmt.Sprintf("./testcase/%s.config.json", name))
+		assert.NoError(t, err, name)
+		assert.Equal(t, string(expected), string(actual.bytes()), name)
+	}
+}
+
+func TestConfigDocument(t *testing.T) {
+	document, err := parseConfigDocument([]byte(`{"a": {"b": 1, "b": 2}, "c": "x\"}"}`))
+	assert.NoError(t, err)
+	value, found, err := document.get([]string{"a", "b"})
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, float64(2), value)
+
+	assert.NoError(t, document.unset([]string{"a", "b"}))
+	assert.Equal(t, `{"a": {}, "c": "x\"}"}`, string(document.bytes()))
+	assert.NoError(t, document.set([]string{"d", "e"}, []string{"<f>"}))
+	assert.Equal(t, `{"a": {}, "c": "x\"}", "d": {"e":["<f>"]}}`, string(document.bytes()))
+	assert.Error(t, document.set([]string{"c", "g"}, "h"))
+
+	_, err = parseConfigDocument([]byte(`[]`))
+	assert.Error(t, err)
+}
+
+func TestDryRunAndCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-edit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.json")
+	original, err := ioutil.ReadFile("./testcase/formatted.config.json")
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(configFile, original, 0644))
+
+	output, err := runConfigEdit(configFile, "--helper", "helper0", "--dry-run")
+	assert.NoError(t, err)
+	assert.Contains(t, output, "--- "+configFile+"\n+++ "+configFile+"\n")
+	assert.Contains(t, output, "-  \"detachKeys\": \"ctrl-e,e\"\n+  \"detachKeys\": \"ctrl-e,e\",\n+  \"credsStore\": \"helper0\"\n }\n")
+
+	output, err = runConfigEdit(configFile, "--helper", "helper0", "--check")
+	assert.EqualError(t, err, "Docker config "+configFile+" is not in the desired state")
+	assert.Empty(t, output)
+	output, err = runConfigEdit(configFile, "get", "credsStore", "--check")
+	assert.EqualError(t, err, "credsStore is not set in "+configFile)
+	assert.Empty(t, output)
+	_, err = runConfigEdit(configFile, "--server", "gcr.io", "--helper", "gcloud", "--check")
+	assert.NoError(t, err)
+
+	edited, err := ioutil.ReadFile(configFile)
+	assert.NoError(t, err)
+	assert.Equal(t, original, edited)
+	_, err = os.Stat(configFile + ".bak")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestConfigDirectory(t *testing.T) {
+	force = true
+	defer func() { force = false }()
+	dir, err := ioutil.TempDir("", "config-edit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer os.Setenv("DOCKER_CONFIG", os.Getenv("DOCKER_CONFIG"))
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", filepath.Join(dir, "home"))
+
+	testCases := []struct {
+		env      string
+		args     []string
+		expected string
+	}{
+		{"", []string{"--config", filepath.Join(dir, "flag")}, filepath.Join(dir, "flag", "config.json")},
+		{filepath.Join(dir, "env"), nil, filepath.Join(dir, "env", "config.json")},
+		{filepath.Join(dir, "env"), []string{"--config", filepath.Join(dir, "flag")}, filepath.Join(dir, "flag", "config.json")},
+	}
+	for _, tc := range testCases {
+		os.Setenv("DOCKER_CONFIG", tc.env)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(tc.expected), 0700))
+		cmd := newEditCommand(ioutil.Discard)
+		cmd.SetArgs(append([]string{"--helper", "helper0"}, tc.args...))
+		assert.NoError(t, cmd.Execute(), "%v", tc.args)
+		configObj, err := loadConfigObject(tc.expected)
+		assert.NoError(t, err)
+		value, found, err := configObj.get([]string{"credsStore"})
+		assert.NoError(t, err)
+		assert.True(t, found, "%v", tc.args)
+		assert.Equal(t, "helper0", value)
+		assert.NoError(t, os.Remove(tc.expected))
+	}
+
+	os.Unsetenv("DOCKER_CONFIG")
+	assert.Equal(t, filepath.Join(userHomeDir(), ".docker"), dockerConfigDir(""))
+	cmd := newEditCommand(ioutil.Discard)
+	cmd.SetOutput(ioutil.Discard)
+	cmd.SetArgs([]string{"--helper", "helper0", "--config", dir, "--config-file", filepath.Join(dir, "config.json")})
+	assert.Error(t, cmd.Execute())
+}
+
+// runConfigEdit runs the config editor on the config file, returning its output
+func runConfigEdit(configFile string, args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := newEditCommand(&out)
+	cmd.SetOutput(&out)
+	cmd.SetArgs(append([]string{"--config-file", configFile}, args...))
+	err := cmd.Execute()
+	return out.String(), err
+}
+
+func toString(obj *configDocument) (output string, err error) {
+	var value interface{}
+	if err = json.Unmarshal(obj.bytes(), &value); err != nil {
+		return "", err
+	}
 	var bytes []byte
-	if bytes, err = json.MarshalIndent(obj, "\n", "\t"); err != nil {
+	if bytes, err = json.MarshalIndent(value, "\n", "\t"); err != nil {
 		return "", err
 	}
 	return string(bytes), nil
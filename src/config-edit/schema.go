@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type schemaKind int
+
+const (
+	// anyKind is a key that is not known, its value is kept as given
+	anyKind schemaKind = iota
+	stringKind
+	// objectKind has known members, other members pass through
+	objectKind
+	// mapKind has keys of any name with values of the element schema
+	mapKind
+	arrayKind
+)
+
+func (k schemaKind) String() string {
+	switch k {
+	case stringKind:
+		return "a string"
+	case objectKind, mapKind:
+		return "an object"
+	case arrayKind:
+		return "an array"
+	default:
+		return "any value"
+	}
+}
+
+// schemaNode describes the type of a value in a config file
+type schemaNode struct {
+	kind    schemaKind
+	members map[string]*schemaNode
+	elem    *schemaNode
+}
+
+var (
+	anySchema    = &schemaNode{kind: anyKind}
+	stringSchema = &schemaNode{kind: stringKind}
+	stringMap    = &schemaNode{kind: mapKind, elem: stringSchema}
+
+	authSchema = &schemaNode{kind: objectKind, members: map[string]*schemaNode{
+		"auth":          stringSchema,
+		"username":      stringSchema,
+		"password":      stringSchema,
+		"email":         stringSchema,
+		"serveraddress": stringSchema,
+		"identitytoken": stringSchema,
+		"registrytoken": stringSchema,
+	}}
+	proxySchema = &schemaNode{kind: objectKind, members: map[string]*schemaNode{
+		"httpProxy":  stringSchema,
+		"httpsProxy": stringSchema,
+		"noProxy":    stringSchema,
+		"ftpProxy":   stringSchema,
+		"allProxy":   stringSchema,
+	}}
+
+	// dockerSchema follows the ConfigFile of the docker cli
+	dockerSchema = &schemaNode{kind: objectKind, members: map[string]*schemaNode{
+		"auths":             {kind: mapKind, elem: authSchema},
+		"HttpHeaders":       stringMap,
+		"psFormat":          stringSchema,
+		"imagesFormat":      stringSchema,
+		"networksFormat":    stringSchema,
+		"pluginsFormat":     stringSchema,
+		"volumesFormat":     stringSchema,
+		"statsFormat":       stringSchema,
+		"detachKeys":        stringSchema,
+		"credsStore":        stringSchema,
+		"credHelpers":       stringMap,
+		"servicesFormat":    stringSchema,
+		"tasksFormat":       stringSchema,
+		"secretFormat":      stringSchema,
+		"configFormat":      stringSchema,
+		"nodesFormat":       stringSchema,
+		"pruneFilters":      {kind: arrayKind, elem: stringSchema},
+		"proxies":           {kind: mapKind, elem: proxySchema},
+		"experimental":      stringSchema,
+		"stackOrchestrator": stringSchema,
+		"kubernetes": {kind: objectKind, members: map[string]*schemaNode{
+			"allNamespaces": stringSchema,
+		}},
+		"currentContext":      stringSchema,
+		"cliPluginsExtraDirs": {kind: arrayKind, elem: stringSchema},
+		"plugins":             {kind: mapKind, elem: stringMap},
+		"aliases":             stringMap,
+		"features":            stringMap,
+	}}
+
+	// containersSchema follows the containers-auth.json of podman, skopeo and
+	// buildah
+	containersSchema = &schemaNode{kind: objectKind, members: map[string]*schemaNode{
+		"auths":       {kind: mapKind, elem: authSchema},
+		"credHelpers": stringMap,
+	}}
+)
+
+// splitConfigPath splits a path such as proxies.default.httpProxy into member
+// keys, a dot that is part of a key is escaped as \.
+func splitConfigPath(path string) ([]string, error) {
+	var keys []string
+	var key bytes.Buffer
+	for i := 0; i < len(path); i++ {
+		switch {
+		case path[i] == '\\' && i+1 < len(path) && (path[i+1] == '.' || path[i+1] == '\\'):
+			i++
+			key.WriteByte(path[i])
+		case path[i] == '.':
+			keys = append(keys, key.String())
+			key.Reset()
+		default:
+			key.WriteByte(path[i])
+		}
+	}
+	keys = append(keys, key.String())
+	for _, key := range keys {
+		if len(key) == 0 {
+			return nil, fmt.Errorf("Invalid path %q, keys must not be empty", path)
+		}
+	}
+	return keys, nil
+}
+
+// resolve returns the member keys of a path along with the schema of its
+// value. Registry names hold dots, so the keys below a map are joined up to
+// the known member of its values, which lets credHelpers.myregistry.azurecr.io
+// name a single entry.
+func (s *schemaNode) resolve(keys []string) ([]string, *schemaNode, error) {
+	var resolved []string
+	node := s
+	for i := 0; i < len(keys); i++ {
+		switch node.kind {
+		case anyKind:
+			resolved = append(resolved, keys[i])
+		case objectKind:
+			resolved = append(resolved, keys[i])
+			if member, found := node.members[keys[i]]; found {
+				node = member
+			} else {
+				node = anySchema
+			}
+		case mapKind:
+			end := i + 1
+			switch node.elem.kind {
+			case stringKind, arrayKind:
+				end = len(keys)
+			case objectKind:
+				end = len(keys)
+				if _, found := node.elem.members[keys[end-1]]; found && end-1 > i {
+					end--
+				}
+			}
+			resolved = append(resolved, strings.Join(keys[i:end], "."))
+			node = node.elem
+			i = end - 1
+		default:
+			return nil, nil, fmt.Errorf("%s is %s", strings.Join(resolved, "."), node.kind)
+		}
+	}
+	return resolved, node, nil
+}
+
+// parseValue reads a value given on the command line. Strings are taken as
+// they are, other known types are read as JSON and checked against the schema,
+// and values of unknown keys are read as JSON when valid or else as strings.
+func (s *schemaNode) parseValue(path string, text string) (interface{}, error) {
+	if s.kind == stringKind {
+		return text, nil
+	}
+	var value interface{}
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	if err == nil && decoder.More() {
+		err = fmt.Errorf("unexpected data after the value")
+	}
+	if err != nil {
+		if s.kind == anyKind {
+			return text, nil
+		}
+		return nil, fmt.Errorf("%s must be %s in JSON, err: %s", path, s.kind, err)
+	}
+	return value, s.validate(path, value)
+}
+
+// validate checks a decoded value against the schema
+func (s *schemaNode) validate(path string, value interface{}) error {
+	switch s.kind {
+	case stringKind:
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s must be %s", path, s.kind)
+		}
+	case objectKind, mapKind:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be %s", path, s.kind)
+		}
+		for key, member := range object {
+			memberSchema := s.elem
+			if s.kind == objectKind {
+				if memberSchema = s.members[key]; memberSchema == nil {
+					continue
+				}
+			}
+			if err := memberSchema.validate(path+"."+key, member); err != nil {
+				return err
+			}
+		}
+	case arrayKind:
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be %s", path, s.kind)
+		}
+		for i, elem := range array {
+			if err := s.elem.validate(fmt.Sprintf("%s[%d]", path, i), elem); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
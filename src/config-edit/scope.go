@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// acrRegistrySuffixes are the domains of the registries of the Azure clouds.
+// Keep them in line with acrDomainSuffixes of docker-credential-acr, so that
+// every registry the helper logs in to is scoped to it.
+var acrRegistrySuffixes = []string{"azurecr.io", "azurecr.cn", "azurecr.us", "azurecr.de"}
+
+// scopeConfigObject points the credHelpers entries of the ACR registries found
+// in auths and credHelpers at the helper, returning their hosts. Registries in
+// domains with the extra suffixes count as ACR registries too. credsStore is
+// left untouched, so other registries keep their helper.
+func scopeConfigObject(configObj *configDocument, helper string, extraSuffixes []string) ([]string, error) {
+	var names []string
+	authsObj, exists, err := configObj.get([]string{"auths"})
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		auths, ok := authsObj.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Error parsing old auths")
+		}
+		for name := range auths {
+			names = append(names, name)
+		}
+	}
+	helperMap, err := credHelpersOf(configObj)
+	if err != nil {
+		return nil, err
+	}
+	for name := range helperMap {
+		names = append(names, name)
+	}
+
+	var suffixes []string
+	for _, suffix := range append(acrRegistrySuffixes, extraSuffixes...) {
+		if suffix = strings.ToLower(strings.TrimLeft(suffix, "*.")); len(suffix) != 0 {
+			suffixes = append(suffixes, suffix)
+		}
+	}
+	found := make(map[string]bool)
+	for _, name := range names {
+		host := registryHost(name)
+		hostname := strings.ToLower(strings.Split(host, ":")[0])
+		for _, suffix := range suffixes {
+			if strings.HasSuffix(hostname, "."+suffix) {
+				found[host] = true
+				break
+			}
+		}
+	}
+
+	var hosts []string
+	for host := range found {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		if err = editConfigObject(configObj, host, helper); err != nil {
+			return nil, err
+		}
+	}
+	return hosts, nil
+}
+
+// registryHost returns the host of a registry as docker looks up its
+// credHelpers entry, auths may be keyed by URLs such as https://host/v1/. The
+// case is kept, docker looks up the host as it was written.
+func registryHost(name string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(name, "http://"), "https://")
+	return strings.Split(host, "/")[0]
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScopeConfigObject(t *testing.T) {
+	testCases := []struct {
+		action   string
+		suffixes []string
+		hosts    []string
+	}{
+		{
+			action: "scoped",
+			hosts:  []string{"MyRegistry.azurecr.io", "contoso.azurecr.cn", "fabrikam.azurecr.us", "tailspin.azurecr.de"},
+		},
+		{
+			action:   "scoped_suffix",
+			suffixes: []string{"*.example.com"},
+			hosts:    []string{"MyRegistry.azurecr.io", "contoso.azurecr.cn", "fabrikam.azurecr.us", "registry.example.com", "tailspin.azurecr.de"},
+		},
+	}
+	for _, tc := range testCases {
+		name := fmt.Sprintf("acr.%s", tc.action)
+		actual, err := loadConfigObject("./testcase/acr.config.json")
+		assert.NoError(t, err, name)
+		hosts, err := scopeConfigObject(actual, "acr-linux", tc.suffixes)
+		assert.NoError(t, err, name)
+		assert.Equal(t, tc.hosts, hosts, name)
+		expected, err := ioutil.ReadFile(fmt.Sprintf("./testcase/%s.config.json", name))
+		assert.NoError(t, err, name)
+		assert.Equal(t, string(expected), string(actual.bytes()), name)
+	}
+}
+
+func TestScopedInstall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-edit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.json")
+	original, err := ioutil.ReadFile("./testcase/formatted.config.json")
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(configFile, original, 0600))
+
+	output, err := runConfigEdit(configFile, "--helper", "acr-linux", "--scoped")
+	assert.NoError(t, err)
+	assert.Contains(t, output, "No ACR registries were found in "+configFile)
+	edited, err := ioutil.ReadFile(configFile)
+	assert.NoError(t, err)
+	assert.Equal(t, original, edited)
+
+	for _, args := range [][]string{
+		{"--helper", "acr-linux", "--scoped", "--server", "myregistry.azurecr.io"},
+		{"--unset", "--scoped"},
+		{"--helper", "acr-linux", "--registry-suffix", "example.com"},
+	} {
+		_, err = runConfigEdit(configFile, args...)
+		assert.Error(t, err, "%v", args)
+	}
+
+	_, err = runConfigEdit(configFile, "set", "auths.myregistry.azurecr.io", "{}")
+	assert.NoError(t, err)
+	_, err = runConfigEdit(configFile, "--helper", "acr-linux", "--scoped")
+	assert.NoError(t, err)
+	output, err = runConfigEdit(configFile, "get", "credHelpers.myregistry.azurecr.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "acr-linux\n", output)
+	_, err = runConfigEdit(configFile, "get", "credsStore")
+	assert.Error(t, err)
+}
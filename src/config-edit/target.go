@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// configTarget is a tool whose config file follows the credsStore and
+// credHelpers layout of the docker config.json
+type configTarget struct {
+	// defaultConfigFile locates the config file when --config-file is not given
+	defaultConfigFile func(configDir string) string
+	// credsStore tells whether the config file has a default helper for all
+	// registries, otherwise only per registry credHelpers entries are supported
+	credsStore bool
+	// schema types the values of the get, set and unset commands
+	schema *schemaNode
+}
+
+var configTargets = map[string]configTarget{
+	"docker": {
+		defaultConfigFile: func(configDir string) string {
+			return filepath.Join(dockerConfigDir(configDir), "config.json")
+		},
+		credsStore: true,
+		schema:     dockerSchema,
+	},
+	// containers-auth.json of podman, skopeo and buildah
+	"containers": {
+		defaultConfigFile: func(string) string { return containersAuthFile() },
+		schema:            containersSchema,
+	},
+	// the registry config of Helm OCI registries, which is a docker config.json
+	"helm": {
+		defaultConfigFile: func(string) string { return helmRegistryConfigFile() },
+		credsStore:        true,
+		schema:            dockerSchema,
+	},
+}
+
+func targetNames() string {
+	var names []string
+	for name := range configTargets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// containersAuthFile returns the auth.json of the containers tools. Without
+// REGISTRY_AUTH_FILE, the file in XDG_RUNTIME_DIR is used when it exists since
+// the tools read it first, otherwise the one in the config home that survives
+// reboots.
+func containersAuthFile() string {
+	if authFile := os.Getenv("REGISTRY_AUTH_FILE"); len(authFile) != 0 {
+		return authFile
+	}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); len(runtimeDir) != 0 {
+		authFile := filepath.Join(runtimeDir, "containers", "auth.json")
+		if _, err := os.Stat(authFile); err == nil {
+			return authFile
+		}
+	}
+	return filepath.Join(xdgConfigHome(), "containers", "auth.json")
+}
+
+// helmRegistryConfigFile returns registry/config.json in the Helm config home
+func helmRegistryConfigFile() string {
+	if configFile := os.Getenv("HELM_REGISTRY_CONFIG"); len(configFile) != 0 {
+		return configFile
+	}
+	configHome := os.Getenv("HELM_CONFIG_HOME")
+	if len(configHome) == 0 {
+		switch {
+		case len(os.Getenv("XDG_CONFIG_HOME")) != 0:
+			configHome = filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "helm")
+		case runtime.GOOS == "darwin":
+			configHome = filepath.Join(userHomeDir(), "Library", "Preferences", "helm")
+		case runtime.GOOS == "windows":
+			configHome = filepath.Join(os.Getenv("APPDATA"), "helm")
+		default:
+			configHome = filepath.Join(xdgConfigHome(), "helm")
+		}
+	}
+	return filepath.Join(configHome, "registry", "config.json")
+}
+
+func xdgConfigHome() string {
+	if configHome := os.Getenv("XDG_CONFIG_HOME"); len(configHome) != 0 {
+		return configHome
+	}
+	return filepath.Join(userHomeDir(), ".config")
+}
+
+// resolveConfigFile returns the config file to edit for the target
+func resolveConfigFile(targetName string, configFile string, configDir string) (string, configTarget, error) {
+	target, found := configTargets[targetName]
+	if !found {
+		return "", target, fmt.Errorf("Unknown target %s, expected one of %s", targetName, targetNames())
+	}
+	if len(configFile) != 0 && len(configDir) != 0 {
+		return "", target, fmt.Errorf("Please specify either --config-file or --config")
+	}
+	if len(configDir) != 0 && targetName != "docker" {
+		return "", target, fmt.Errorf("--config only applies to the docker target, please use --config-file")
+	}
+	if len(configFile) == 0 {
+		configFile = target.defaultConfigFile(configDir)
+	}
+	return configFile, target, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setenv sets environment variables for a test, returning a func restoring them
+func setenv(values map[string]string) func() {
+	old := make(map[string]string)
+	for name, value := range values {
+		old[name] = os.Getenv(name)
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name, value := range old {
+			os.Setenv(name, value)
+		}
+	}
+}
+
+func TestContainersAuthFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-edit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer setenv(map[string]string{
+		"REGISTRY_AUTH_FILE": "",
+		"XDG_RUNTIME_DIR":    filepath.Join(dir, "run"),
+		"XDG_CONFIG_HOME":    filepath.Join(dir, "config"),
+	})()
+
+	assert.Equal(t, filepath.Join(dir, "config", "containers", "auth.json"), containersAuthFile())
+
+	runtimeFile := filepath.Join(dir, "run", "containers", "auth.json")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(runtimeFile), 0700))
+	assert.NoError(t, ioutil.WriteFile(runtimeFile, []byte("{}"), 0600))
+	assert.Equal(t, runtimeFile, containersAuthFile())
+
+	os.Setenv("REGISTRY_AUTH_FILE", filepath.Join(dir, "auth.json"))
+	assert.Equal(t, filepath.Join(dir, "auth.json"), containersAuthFile())
+}
+
+func TestHelmRegistryConfigFile(t *testing.T) {
+	defer setenv(map[string]string{
+		"HELM_REGISTRY_CONFIG": "",
+		"HELM_CONFIG_HOME":     "",
+		"XDG_CONFIG_HOME":      "/xdg",
+	})()
+
+	assert.Equal(t, filepath.Join("/xdg", "helm", "registry", "config.json"), helmRegistryConfigFile())
+	os.Setenv("HELM_CONFIG_HOME", "/helm")
+	assert.Equal(t, filepath.Join("/helm", "registry", "config.json"), helmRegistryConfigFile())
+	os.Setenv("HELM_REGISTRY_CONFIG", "/registry.json")
+	assert.Equal(t, "/registry.json", helmRegistryConfigFile())
+
+	os.Setenv("HELM_REGISTRY_CONFIG", "")
+	os.Setenv("HELM_CONFIG_HOME", "")
+	os.Setenv("XDG_CONFIG_HOME", "")
+	if runtime.GOOS == "linux" {
+		assert.Equal(t, filepath.Join(userHomeDir(), ".config", "helm", "registry", "config.json"), helmRegistryConfigFile())
+	}
+}
+
+func TestEditTargets(t *testing.T) {
+	force = true
+	defer func() { force = false }()
+	dir, err := ioutil.TempDir("", "config-edit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	authFile := filepath.Join(dir, "containers", "auth.json")
+	helmFile := filepath.Join(dir, "helm", "registry", "config.json")
+	defer setenv(map[string]string{
+		"REGISTRY_AUTH_FILE":   authFile,
+		"HELM_REGISTRY_CONFIG": helmFile,
+	})()
+
+	original, err := ioutil.ReadFile("./testcase/containers.config.json")
+	assert.NoError(t, err)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(authFile), 0700))
+	assert.NoError(t, ioutil.WriteFile(authFile, original, 0600))
+	cmd := newEditCommand(ioutil.Discard)
+	cmd.SetArgs([]string{"--target", "containers", "--server", "myregistry.azurecr.io", "--helper", "acr-linux"})
+	assert.NoError(t, cmd.Execute())
+	expected, err := ioutil.ReadFile("./testcase/containers.added_helper.config.json")
+	assert.NoError(t, err)
+	actual, err := ioutil.ReadFile(authFile)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), string(actual))
+
+	cmd = newEditCommand(ioutil.Discard)
+	cmd.SetOutput(ioutil.Discard)
+	cmd.SetArgs([]string{"--target", "containers", "--helper", "acr-linux"})
+	assert.Error(t, cmd.Execute())
+
+	cmd = newEditCommand(ioutil.Discard)
+	cmd.SetArgs([]string{"--target", "helm", "--server", "myregistry.azurecr.io", "--helper", "acr-linux"})
+	assert.NoError(t, cmd.Execute())
+	configObj, err := loadConfigObject(helmFile)
+	assert.NoError(t, err)
+	value, _, err := configObj.get([]string{"credHelpers", "myregistry.azurecr.io"})
+	assert.NoError(t, err)
+	assert.Equal(t, "acr-linux", value)
+	if runtime.GOOS != "windows" {
+		fileInfo, err := os.Stat(helmFile)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), fileInfo.Mode().Perm())
+	}
+
+	cmd = newEditCommand(ioutil.Discard)
+	cmd.SetOutput(ioutil.Discard)
+	cmd.SetArgs([]string{"--target", "rkt", "--helper", "acr-linux"})
+	assert.Error(t, cmd.Execute())
+}
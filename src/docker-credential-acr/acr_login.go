@@ -7,10 +7,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path"
 	"strconv"
 	"strings"
 	"time"
-	"unicode"
 
 	"github.com/Sirupsen/logrus"
 	jwt "github.com/dgrijalva/jwt-go"
@@ -39,7 +39,13 @@ type acrAuthResponse struct {
 const timeShiftBuffer = 300
 const userAgentHeader = "User-Agent"
 
-var client = &http.Client{}
+// domain suffixes of the ACR login servers in the public and sovereign clouds,
+// mirrored by acrRegistrySuffixes of config-edit
+var acrDomainSuffixes = []string{".azurecr.io", ".azurecr.cn", ".azurecr.us", ".azurecr.de"}
+
+// client is used for every request to registries and AAD, main replaces it
+// with one configured from the helper config
+var client = &http.Client{Timeout: defaultHTTPTimeout}
 var userAgentVersion string
 
 func getUserAgent() string {
@@ -53,6 +59,17 @@ func (token *acrTokenPayload) isExpiredOrNear() bool {
 	return time.Now().Unix() > token.Expiration-timeShiftBuffer
 }
 
+// isAcrLoginServer reports whether the server address belongs to an ACR registry
+func isAcrLoginServer(serverAddress string) bool {
+	hostname := registryHostname(serverAddress)
+	for _, suffix := range acrDomainSuffixes {
+		if strings.HasSuffix(hostname, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
 // GetUsernamePassword get the AAD based ACR login credentials
 func GetUsernamePassword(serverAddress string, identityToken string) (user string, cred string, err error) {
 	if identityToken == "" {
@@ -62,40 +79,69 @@ func GetUsernamePassword(serverAddress string, identityToken string) (user strin
 	var acrToken *acrTokenPayload
 	acrToken, err = parseAcrToken(identityToken)
 	if err != nil {
+		// identity tokens of other registries are opaque to us, hand them
+		// back untouched if the registry confirms it is not an ACR registry
+		if _, err = receiveChallengeFromLoginServer(serverAddress); isNonAcrChallenge(err) {
+			return tokenUsername, identityToken, nil
+		}
 		return "", "", fmt.Errorf("Bad identity token")
 	}
+	logrus.WithFields(tokenExpiryFields(acrToken)).WithField("server", serverAddress).Debug("Stored identity token")
 	refreshToken := identityToken
 	if acrToken.isExpiredOrNear() {
 		var challenge *authDirective
-		if challenge, err = receiveChallengeFromLoginServer(serverAddress); err != nil {
-			// ignore all error when receiving the challenge
-			logrus.Infof("[Azure Login Helper] server %s didn't respond with a valid challenge, reverting to default login...\nerror: %s\n", serverAddress, err)
-			return "", "", nil
+		if challenge, err = receiveChallengeFromLoginServer(serverAddress); isNonAcrChallenge(err) {
+			return tokenUsername, identityToken, nil
+		} else if isRegistryUnreachable(err) || isRegistryUnavailable(err) {
+			return "", "", err
+		} else if err != nil {
+			return "", "", fmt.Errorf("Registry %s did not respond with a valid challenge, error: %s", serverAddress, err)
+		}
+		if refreshToken, err = performTokenExchange(serverAddress, challenge, acrToken.TenantID, acrToken.Credential); err != nil {
+			if isRegistryUnreachable(err) || isRegistryUnavailable(err) {
+				return "", "", err
+			}
+			return "", "", &tokenExpiredError{server: serverAddress, cause: err}
+		}
+		if err = verifyTenant(serverAddress, acrToken.TenantID, refreshToken); err != nil {
+			return "", "", err
 		}
-		refreshToken, err = performTokenExchange(serverAddress, challenge, acrToken.TenantID, acrToken.Credential)
 	}
 
 	return tokenUsername, refreshToken, nil
 }
 
 func receiveChallengeFromLoginServer(serverAddress string) (*authDirective, error) {
+	// auths may be keyed by URLs such as https://index.docker.io/v1/
 	challengeURL := url.URL{
 		Scheme: "https",
-		Host:   serverAddress,
+		Host:   registryHost(serverAddress),
 		Path:   "v2/",
 	}
-	var err error
-	var r *http.Request
-	r, _ = http.NewRequest("GET", challengeURL.String(), nil)
+	r, err := http.NewRequest("GET", challengeURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
 	r.Header.Add(userAgentHeader, getUserAgent())
+	// the request has no body, so every attempt can send it again
+	newRequest := func() *http.Request {
+		return r
+	}
+	logrus.WithField("url", challengeURL.String()).Debug("Requesting challenge")
 	var challenge *http.Response
-	if challenge, err = client.Do(r); err != nil {
-		return nil, fmt.Errorf("Error reaching registry endpoint %s, error: %s", challengeURL.String(), err)
+	if challenge, err = retry.do(newRequest, retryIdempotent); err != nil {
+		logrus.WithField("url", challengeURL.String()).WithError(err).Debug("Challenge request failed")
+		return nil, &registryUnreachableError{server: serverAddress, url: challengeURL.String(), cause: err}
 	}
 	defer challenge.Body.Close()
+	logrus.WithFields(logrus.Fields{
+		"url":             challengeURL.String(),
+		"status":          challenge.StatusCode,
+		"wwwAuthenticate": challenge.Header["Www-Authenticate"],
+	}).Debug("Received challenge response")
 
 	if challenge.StatusCode != 401 {
-		return nil, fmt.Errorf("Registry did not issue a valid AAD challenge, status: %d", challenge.StatusCode)
+		return nil, &registryUnavailableError{server: serverAddress, url: challengeURL.String(), status: challenge.StatusCode}
 	}
 
 	var authHeader []string
@@ -104,35 +150,88 @@ func receiveChallengeFromLoginServer(serverAddress string) (*authDirective, erro
 		return nil, fmt.Errorf("Challenge response does not contain header 'Www-Authenticate'")
 	}
 
-	if len(authHeader) != 1 {
-		return nil, fmt.Errorf("Registry did not issue a valid AAD challenge, authenticate header [%s]",
-			strings.Join(authHeader, ", "))
-	}
-
-	authSections := strings.SplitN(authHeader[0], " ", 2)
-	authType := strings.ToLower(authSections[0])
-	var authParams *map[string]string
-	if authParams, err = parseAssignments(authSections[1]); err != nil {
-		return nil, fmt.Errorf("Unable to understand the contents of Www-Authenticate header %s", authSections[1])
+	var challenges []authChallenge
+	if challenges, err = parseChallenges(authHeader); err != nil {
+		return nil, fmt.Errorf("Unable to understand the contents of Www-Authenticate header [%s], error: %s",
+			strings.Join(authHeader, ", "), err)
 	}
 
 	// verify headers
-	if !strings.EqualFold("Bearer", authType) {
-		return nil, fmt.Errorf("Www-Authenticate: expected realm: Bearer, actual: %s", authType)
+	bearer := findChallenge(challenges, "Bearer")
+	if bearer == nil {
+		if findChallenge(challenges, "Basic") != nil {
+			return nil, &nonAcrChallengeError{challenge: strings.Join(authHeader, ", ")}
+		}
+		return nil, fmt.Errorf("Www-Authenticate: expected realm: Bearer, actual: [%s]", strings.Join(authHeader, ", "))
 	}
-	if len((*authParams)["service"]) == 0 {
+	if len(bearer.params["service"]) == 0 {
 		return nil, fmt.Errorf("Www-Authenticate: missing header \"service\"")
 	}
-	if len((*authParams)["realm"]) == 0 {
+	if len(bearer.params["realm"]) == 0 {
 		return nil, fmt.Errorf("Www-Authenticate: missing header \"realm\"")
 	}
+	if !isAcrTokenRealm(bearer.params["realm"]) && settings.registry(serverAddress).ExchangeEndpoint == "" {
+		return nil, &nonAcrChallengeError{challenge: strings.Join(authHeader, ", ")}
+	}
 
 	return &authDirective{
-		service: (*authParams)["service"],
-		realm:   (*authParams)["realm"],
+		service: bearer.params["service"],
+		realm:   bearer.params["realm"],
 	}, nil
 }
 
+// exchangeEndpoint returns the endpoint to exchange tokens at for a registry.
+// Unless overridden in the helper config, it is derived from the challenge
+// realm by replacing the last path segment of the realm with "exchange" and
+// dropping the query, so https://host/prefix/oauth2/token becomes
+// https://host/prefix/oauth2/exchange. A realm without a path maps to
+// /oauth2/exchange on the realm host.
+func exchangeEndpoint(serverAddress string, realm string) (string, error) {
+	if override := settings.registry(serverAddress).ExchangeEndpoint; override != "" {
+		return override, nil
+	}
+	realmURL, err := url.Parse(realm)
+	if err != nil || realmURL.Scheme == "" || realmURL.Host == "" {
+		return "", fmt.Errorf("Www-Authenticate: invalid realm %s", realm)
+	}
+	realmPath := strings.TrimSuffix(realmURL.Path, "/")
+	var exchangePath string
+	if realmPath == "" {
+		exchangePath = "/oauth2/exchange"
+	} else {
+		exchangePath = path.Join(path.Dir(realmPath), "exchange")
+	}
+	exchangeURL := url.URL{
+		Scheme: realmURL.Scheme,
+		Host:   realmURL.Host,
+		Path:   exchangePath,
+	}
+	return exchangeURL.String(), nil
+}
+
+// isAcrTokenRealm reports whether the Bearer realm is served by an ACR token
+// service, whose realm is the /oauth2/token endpoint of the login server
+func isAcrTokenRealm(realm string) bool {
+	realmURL, err := url.Parse(realm)
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(strings.TrimSuffix(realmURL.Path, "/"), "/oauth2/token")
+}
+
+// verifyTenant checks that the registry issued the refresh token for the
+// tenant it was requested for
+func verifyTenant(serverAddress string, tenant string, refreshToken string) error {
+	refreshed, err := parseAcrToken(refreshToken)
+	if err != nil {
+		return &tokenExpiredError{server: serverAddress, cause: err}
+	}
+	if tenant != "" && refreshed.TenantID != "" && !strings.EqualFold(tenant, refreshed.TenantID) {
+		return &tenantMismatchError{server: serverAddress, expected: tenant, actual: refreshed.TenantID}
+	}
+	return nil
+}
+
 func parseAcrToken(identityToken string) (token *acrTokenPayload, err error) {
 	tokenSegments := strings.Split(identityToken, ".")
 	if len(tokenSegments) < 2 {
@@ -155,33 +254,65 @@ func performTokenExchange(
 	directive *authDirective,
 	tenant string,
 	refreshTokenEncoded string) (string, error) {
-	var err error
 	data := url.Values{
 		"service":       []string{directive.service},
 		"grant_type":    []string{"refresh_token"},
 		"refresh_token": []string{refreshTokenEncoded},
 		"tenant":        []string{tenant},
 	}
+	return postTokenExchange(serverAddress, directive, data)
+}
 
-	var realmURL *url.URL
-	if realmURL, err = url.Parse(directive.realm); err != nil {
-		return "", fmt.Errorf("Www-Authenticate: invalid realm %s", directive.realm)
+func performAccessTokenExchange(
+	serverAddress string,
+	directive *authDirective,
+	tenant string,
+	accessToken string) (string, error) {
+	data := url.Values{
+		"service":      []string{directive.service},
+		"grant_type":   []string{"access_token"},
+		"access_token": []string{accessToken},
+	}
+	if tenant != "" {
+		data.Set("tenant", tenant)
+	}
+	return postTokenExchange(serverAddress, directive, data)
+}
+
+func postTokenExchange(serverAddress string, directive *authDirective, data url.Values) (string, error) {
+	var err error
+	var authEndpoint string
+	if authEndpoint, err = exchangeEndpoint(serverAddress, directive.realm); err != nil {
+		return "", err
 	}
-	authEndpoint := fmt.Sprintf("%s://%s/oauth2/exchange", realmURL.Scheme, realmURL.Host)
 
 	datac := data.Encode()
-	var r *http.Request
-	r, _ = http.NewRequest("POST", authEndpoint, bytes.NewBufferString(datac))
-	r.Header.Add(userAgentHeader, getUserAgent())
-	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	r.Header.Add("Content-Length", strconv.Itoa(len(datac)))
+	newRequest := func() *http.Request {
+		r, _ := http.NewRequest("POST", authEndpoint, bytes.NewBufferString(datac))
+		r.Header.Add(userAgentHeader, getUserAgent())
+		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Add("Content-Length", strconv.Itoa(len(datac)))
+		return r
+	}
+	logrus.WithFields(logrus.Fields{
+		"url":  authEndpoint,
+		"form": redactForm(data).Encode(),
+	}).Debug("Requesting token exchange")
 
 	var exchange *http.Response
-	if exchange, err = client.Do(r); err != nil {
-		return "", fmt.Errorf("Www-Authenticate: failed to reach auth url %s", authEndpoint)
+	if exchange, err = retry.do(newRequest, retryThrottled); err != nil {
+		logrus.WithField("url", authEndpoint).WithError(err).Debug("Token exchange request failed")
+		return "", &registryUnreachableError{server: serverAddress, url: authEndpoint, cause: err}
 	}
 
 	defer exchange.Body.Close()
+	logrus.WithFields(logrus.Fields{
+		"url":    authEndpoint,
+		"status": exchange.StatusCode,
+	}).Debug("Received token exchange response")
+	if exchange.StatusCode >= 500 {
+		return "", &registryUnavailableError{server: serverAddress, url: authEndpoint, status: exchange.StatusCode}
+	}
 	if exchange.StatusCode != 200 {
 		return "", fmt.Errorf("Www-Authenticate: auth url %s responded with status code %d", authEndpoint, exchange.StatusCode)
 	}
@@ -193,98 +324,14 @@ func performTokenExchange(
 
 	var authResp acrAuthResponse
 	if err = json.Unmarshal(content, &authResp); err != nil {
-		return "", fmt.Errorf("Www-Authenticate: unable to read response %s", content)
-	}
-
-	return authResp.RefreshToken, nil
-}
-
-// Try and parse a string of assignments in the form of:
-// key1 = value1, key2 = "value 2", key3 = ""
-// Note: this method and handle quotes but does not handle escaping of quotes
-func parseAssignments(statements string) (*map[string]string, error) {
-	var cursor int
-	result := make(map[string]string)
-	var errorMsg = fmt.Errorf("malformed header value: %s", statements)
-	for {
-		// parse key
-		equalIndex := nextOccurrence(statements, cursor, "=")
-		if equalIndex == -1 {
-			return nil, errorMsg
-		}
-		key := strings.TrimSpace(statements[cursor:equalIndex])
-
-		// parse value
-		cursor = nextNoneSpace(statements, equalIndex+1)
-		if cursor == -1 {
-			return nil, errorMsg
-		}
-		// case: value is quoted
-		if statements[cursor] == '"' {
-			cursor = cursor + 1
-			// like I said, not handling escapes, but this will skip any comma that's
-			// within the quotes which is somewhat more likely
-			closeQuoteIndex := nextOccurrence(statements, cursor, "\"")
-			if closeQuoteIndex == -1 {
-				return nil, errorMsg
-			}
-			value := statements[cursor:closeQuoteIndex]
-			result[key] = value
-
-			commaIndex := nextNoneSpace(statements, closeQuoteIndex+1)
-			if commaIndex == -1 {
-				// no more comma, done
-				return &result, nil
-			} else if statements[commaIndex] != ',' {
-				// expect comma immediately after close quote
-				return nil, errorMsg
-			} else {
-				cursor = commaIndex + 1
-			}
-		} else {
-			commaIndex := nextOccurrence(statements, cursor, ",")
-			endStatements := commaIndex == -1
-			var untrimmed string
-			if endStatements {
-				untrimmed = statements[cursor:commaIndex]
-			} else {
-				untrimmed = statements[cursor:]
-			}
-			value := strings.TrimSpace(untrimmed)
-
-			if len(value) == 0 {
-				// disallow empty value without quote
-				return nil, errorMsg
-			}
-
-			result[key] = value
-
-			if endStatements {
-				return &result, nil
-			}
-			cursor = commaIndex + 1
-		}
-	}
-}
-
-func nextOccurrence(str string, start int, sep string) int {
-	if start >= len(str) {
-		return -1
+		return "", fmt.Errorf("Www-Authenticate: unable to read response from %s", authEndpoint)
 	}
-	offset := strings.Index(str[start:], sep)
-	if offset == -1 {
-		return -1
+	if authResp.RefreshToken == "" {
+		return "", fmt.Errorf("Www-Authenticate: auth url %s did not return a refresh token", authEndpoint)
 	}
-	return offset + start
-}
 
-func nextNoneSpace(str string, start int) int {
-	if start >= len(str) {
-		return -1
+	if refreshed, err := parseAcrToken(authResp.RefreshToken); err == nil {
+		logrus.WithFields(tokenExpiryFields(refreshed)).WithField("url", authEndpoint).Debug("Exchanged refresh token")
 	}
-	offset := strings.IndexFunc(str[start:], func(c rune) bool { return !unicode.IsSpace(c) })
-	if offset == -1 {
-		return -1
-	}
-	return offset + start
+	return authResp.RefreshToken, nil
 }
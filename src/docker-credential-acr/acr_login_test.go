@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	helperCredentials "github.com/docker/docker-credential-helpers/credentials"
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExchangeEndpoint(t *testing.T) {
+	defer func(old *helperConfig) { settings = old }(settings)
+	settings = &helperConfig{Registries: map[string]registryConfig{
+		"private.azurecr.io": {ExchangeEndpoint: "https://private.privatelink.azurecr.io/oauth2/exchange"},
+	}}
+
+	testCases := []struct {
+		server   string
+		realm    string
+		expected string
+		fails    bool
+	}{
+		{
+			server:   "myregistry.azurecr.io",
+			realm:    "https://myregistry.azurecr.io/oauth2/token",
+			expected: "https://myregistry.azurecr.io/oauth2/exchange",
+		},
+		{
+			server:   "myregistry.azurecr.cn",
+			realm:    "https://myregistry.azurecr.cn/oauth2/token?service=x",
+			expected: "https://myregistry.azurecr.cn/oauth2/exchange",
+		},
+		{
+			server:   "localhost:5000",
+			realm:    "http://localhost:5000/acr/oauth2/token/",
+			expected: "http://localhost:5000/acr/oauth2/exchange",
+		},
+		{
+			server:   "localhost:5000",
+			realm:    "https://localhost:5000",
+			expected: "https://localhost:5000/oauth2/exchange",
+		},
+		{
+			server:   "https://PRIVATE.azurecr.io/",
+			realm:    "https://private.azurecr.io/oauth2/token",
+			expected: "https://private.privatelink.azurecr.io/oauth2/exchange",
+		},
+		{
+			server: "myregistry.azurecr.io",
+			realm:  "/oauth2/token",
+			fails:  true,
+		},
+	}
+	for _, tc := range testCases {
+		actual, err := exchangeEndpoint(tc.server, tc.realm)
+		if tc.fails {
+			assert.Error(t, err, tc.realm)
+			continue
+		}
+		assert.NoError(t, err, tc.realm)
+		assert.Equal(t, tc.expected, actual, tc.realm)
+	}
+}
+
+func TestTokenExchangeUsesRealmPrefix(t *testing.T) {
+	defer useInsecureClient()()
+	refreshed := makeAcrToken(time.Now().Add(3*time.Hour), "tenant", "new")
+	registry := newFakeRegistry(refreshed)
+	defer registry.Close()
+	registry.challenge = fmt.Sprintf(`Bearer realm="https://%s/tokens/oauth2/token",service="%s"`, registry.host(), registry.host())
+
+	store := newMemoryStore()
+	store.Store(dockerTypes.AuthConfig{
+		ServerAddress: registry.host(),
+		Username:      tokenUsername,
+		IdentityToken: makeAcrToken(time.Now().Add(-time.Hour), "tenant", "old"),
+	})
+
+	_, cred, err := newTestWrapper(store).Get(registry.host())
+	assert.NoError(t, err)
+	assert.Equal(t, refreshed, cred)
+	assert.Equal(t, "/tokens/oauth2/exchange", registry.lastPath)
+}
+
+func TestTokenExchangeOverride(t *testing.T) {
+	defer useInsecureClient()()
+	refreshed := makeAcrToken(time.Now().Add(3*time.Hour), "tenant", "new")
+	registry := newFakeRegistry(refreshed)
+	defer registry.Close()
+	// a realm that would not be recognized as ACR without the override
+	registry.challenge = fmt.Sprintf(`Bearer realm="https://%s/token",service="%s"`, registry.host(), registry.host())
+
+	defer func(old *helperConfig) { settings = old }(settings)
+	settings = &helperConfig{Registries: map[string]registryConfig{
+		registry.host(): {ExchangeEndpoint: fmt.Sprintf("https://%s/custom/exchange", registry.host())},
+	}}
+
+	store := newMemoryStore()
+	store.Store(dockerTypes.AuthConfig{
+		ServerAddress: registry.host(),
+		Username:      tokenUsername,
+		IdentityToken: makeAcrToken(time.Now().Add(-time.Hour), "tenant", "old"),
+	})
+
+	_, cred, err := newTestWrapper(store).Get(registry.host())
+	assert.NoError(t, err)
+	assert.Equal(t, refreshed, cred)
+	assert.Equal(t, "/custom/exchange", registry.lastPath)
+}
+
+func TestGetErrors(t *testing.T) {
+	defer useInsecureClient()()
+	_, restore := useTestRetry(1)
+	defer restore()
+
+	testCases := []struct {
+		name          string
+		setup         func(registry *fakeRegistry)
+		check         func(err error) bool
+		expectMessage string
+	}{
+		{
+			name:          "exchange rejected",
+			setup:         func(registry *fakeRegistry) { registry.exchangeStatus = http.StatusUnauthorized },
+			check:         isTokenExpired,
+			expectMessage: "run 'az acr login' again",
+		},
+		{
+			name:          "registry unreachable",
+			setup:         func(registry *fakeRegistry) { registry.server.Close() },
+			check:         isRegistryUnreachable,
+			expectMessage: "Unable to reach",
+		},
+		{
+			name:          "registry unavailable",
+			setup:         func(registry *fakeRegistry) { registry.challengeStatus = http.StatusServiceUnavailable },
+			check:         isRegistryUnavailable,
+			expectMessage: "responded with status 503",
+		},
+		{
+			name:          "token service unavailable",
+			setup:         func(registry *fakeRegistry) { registry.exchangeStatus = http.StatusBadGateway },
+			check:         isRegistryUnavailable,
+			expectMessage: "responded with status 502",
+		},
+		{
+			name: "tenant mismatch",
+			setup: func(registry *fakeRegistry) {
+				registry.newToken = makeAcrToken(time.Now().Add(3*time.Hour), "other-tenant", "new")
+			},
+			check:         isTenantMismatch,
+			expectMessage: "instead of tenant tenant",
+		},
+	}
+	for _, tc := range testCases {
+		registry := newFakeRegistry(makeAcrToken(time.Now().Add(3*time.Hour), "tenant", "new"))
+		host := registry.host()
+		tc.setup(registry)
+		store := newMemoryStore()
+		expired := makeAcrToken(time.Now().Add(-time.Hour), "tenant", "old")
+		store.Store(dockerTypes.AuthConfig{
+			ServerAddress: host,
+			Username:      tokenUsername,
+			IdentityToken: expired,
+		})
+		wrapper := newTestWrapper(store)
+
+		_, _, err := wrapper.Get(host)
+		assert.True(t, tc.check(err), "%s: unexpected error %v", tc.name, err)
+
+		var out bytes.Buffer
+		err = helperCredentials.HandleCommand(wrapper, "get", strings.NewReader(host), &out)
+		if assert.Error(t, err, tc.name) {
+			assert.Contains(t, err.Error(), tc.expectMessage, tc.name)
+		}
+		assert.Equal(t, "", out.String(), tc.name)
+		assert.Equal(t, expired, store.auths[host].IdentityToken, tc.name)
+		registry.Close()
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/cli/cli/config/configfile"
+	dockerCredentials "github.com/docker/cli/cli/config/credentials"
+	"github.com/docker/docker/pkg/ioutils"
+)
+
+// storeConfig controls where the credentials are kept
+type storeConfig struct {
+	// Backends are tried in order until one is available and healthy. An
+	// entry is either "encrypted-file", "file" or the name of a docker
+	// credential helper such as "pass" for docker-credential-pass. Defaults to
+	// the native helper of the platform followed by "encrypted-file" and "file".
+	Backends []string `json:"backends,omitempty"`
+	// ProbeTimeout bounds the health probe of a credential helper, as a
+	// duration such as "5s"
+	ProbeTimeout string `json:"probeTimeout,omitempty"`
+	// ProbeCacheTTL is how long the outcome of a health probe is reused by
+	// the credential lookups of docker, as a duration such as "10m". "0s"
+	// probes on every lookup.
+	ProbeCacheTTL string `json:"probeCacheTTL,omitempty"`
+	// MaxSecretSize maps credential helpers to the largest secret in bytes
+	// they can hold, larger secrets are split across several entries. Helpers
+	// with a known limit, such as wincred, need no entry.
+	MaxSecretSize map[string]int `json:"maxSecretSize,omitempty"`
+}
+
+const (
+	envStoreBackends = "DOCKER_CREDENTIAL_ACR_STORE_BACKENDS"
+
+	encryptedFileBackend = "encrypted-file"
+	fileBackend          = "file"
+
+	defaultProbeTimeout  = 5 * time.Second
+	defaultProbeCacheTTL = 10 * time.Minute
+
+	// probeCacheFile in the acr directory keeps the outcomes of the health
+	// probes of credential helpers
+	probeCacheFile = "probes.json"
+)
+
+// applyEnvironment overrides the backends with the comma separated list in
+// DOCKER_CREDENTIAL_ACR_STORE_BACKENDS
+func (c *storeConfig) applyEnvironment() {
+	if backends := os.Getenv(envStoreBackends); backends != "" {
+		c.Backends = nil
+		for _, backend := range strings.Split(backends, ",") {
+			if backend = strings.TrimSpace(backend); backend != "" {
+				c.Backends = append(c.Backends, backend)
+			}
+		}
+	}
+}
+
+// backends returns the backend chain, the default one if none is configured
+func (c *storeConfig) backends() []string {
+	if len(c.Backends) > 0 {
+		return c.Backends
+	}
+	// NOTE: This tool would use secretservice for linux and osxkeychain for
+	// osx if they are healthy. wincred is not used for windows since it cannot
+	// hold tokens larger than 2.5KB.
+	var backends []string
+	if helperSuffix != "" {
+		backends = append(backends, helperSuffix)
+	}
+	return append(backends, encryptedFileBackend, fileBackend)
+}
+
+// maxSecretSize returns the secret size limit of a credential helper, zero
+// when it has none
+func (c *storeConfig) maxSecretSize(backend string) int {
+	if maxSize, found := c.MaxSecretSize[backend]; found {
+		return maxSize
+	}
+	return helperSecretSizeLimits[backend]
+}
+
+func (c *storeConfig) probeTimeout() (time.Duration, error) {
+	if c.ProbeTimeout == "" {
+		return defaultProbeTimeout, nil
+	}
+	timeout, err := time.ParseDuration(c.ProbeTimeout)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("Invalid store probe timeout %s", c.ProbeTimeout)
+	}
+	return timeout, nil
+}
+
+func (c *storeConfig) probeCacheTTL() (time.Duration, error) {
+	if c.ProbeCacheTTL == "" {
+		return defaultProbeCacheTTL, nil
+	}
+	ttl, err := time.ParseDuration(c.ProbeCacheTTL)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf("Invalid store probe cache TTL %s", c.ProbeCacheTTL)
+	}
+	return ttl, nil
+}
+
+// helperProber runs the health probes of credential helpers. Docker runs the
+// helper for every credential lookup, so recent outcomes are reused from the
+// cache file unless refresh is set, as it is for the admin commands.
+type helperProber struct {
+	timeout   time.Duration
+	cacheFile string
+	cacheTTL  time.Duration
+	refresh   bool
+}
+
+// probeOutcome is the outcome of a health probe kept in the cache file
+type probeOutcome struct {
+	Path    string    `json:"path"`
+	Checked time.Time `json:"checked"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func newHelperProber(config *configfile.ConfigFile, storeSettings storeConfig, refresh bool) (*helperProber, error) {
+	timeout, err := storeSettings.probeTimeout()
+	if err != nil {
+		return nil, err
+	}
+	cacheTTL, err := storeSettings.probeCacheTTL()
+	if err != nil {
+		return nil, err
+	}
+	return &helperProber{
+		timeout:   timeout,
+		cacheFile: filepath.Join(secondaryFileStoreDir(config), probeCacheFile),
+		cacheTTL:  cacheTTL,
+		refresh:   refresh,
+	}, nil
+}
+
+// probe checks the health of the helper, reusing a cached outcome for the
+// same executable that is younger than the cache TTL
+func (p *helperProber) probe(helperName string) error {
+	path, err := exec.LookPath(helperName)
+	if err != nil {
+		return fmt.Errorf("%s is not found", helperName)
+	}
+	outcomes := p.readCache()
+	if outcome, found := outcomes[helperName]; found && !p.refresh && outcome.Path == path &&
+		time.Since(outcome.Checked) < p.cacheTTL {
+		logrus.WithField("helper", helperName).WithField("checked", outcome.Checked).Debug("Using cached credential helper probe")
+		if outcome.Error != "" {
+			return errors.New(outcome.Error)
+		}
+		return nil
+	}
+
+	err = probeCredentialHelper(helperName, p.timeout)
+	if p.cacheTTL > 0 {
+		outcome := probeOutcome{Path: path, Checked: time.Now()}
+		if err != nil {
+			outcome.Error = err.Error()
+		}
+		outcomes[helperName] = outcome
+		p.writeCache(outcomes)
+	}
+	return err
+}
+
+// readCache returns the cached outcomes, none when the cache is missing or
+// unreadable
+func (p *helperProber) readCache() map[string]probeOutcome {
+	outcomes := make(map[string]probeOutcome)
+	if content, err := ioutil.ReadFile(p.cacheFile); err == nil {
+		if err = json.Unmarshal(content, &outcomes); err != nil {
+			outcomes = make(map[string]probeOutcome)
+		}
+	}
+	return outcomes
+}
+
+// writeCache saves the outcomes, failing to do so only costs another probe
+func (p *helperProber) writeCache(outcomes map[string]probeOutcome) {
+	content, err := json.Marshal(outcomes)
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(p.cacheFile), 0700); err == nil {
+			err = ioutils.AtomicWriteFile(p.cacheFile, content, 0600)
+		}
+	}
+	if err != nil {
+		logrus.WithField("file", p.cacheFile).WithError(err).Debug("Unable to cache credential helper probes")
+	}
+}
+
+// selectStoreBackend opens the first backend of the chain that is available
+// and healthy. It returns the store along with a description of the backend.
+// Refresh probes the credential helpers again instead of using cached outcomes.
+func selectStoreBackend(config *configfile.ConfigFile, storeSettings storeConfig, refresh bool) (*dockerCredentials.Store, string, error) {
+	prober, err := newHelperProber(config, storeSettings, refresh)
+	if err != nil {
+		return nil, "", err
+	}
+	var failures []string
+	for _, backend := range storeSettings.backends() {
+		store, description, err := openStoreBackend(config, backend, storeSettings, prober)
+		if err == nil {
+			logrus.WithField("backend", description).Debug("Using credential store")
+			return store, description, nil
+		}
+		logrus.WithField("backend", backend).WithError(err).Debug("Skipping unavailable credential store")
+		failures = append(failures, fmt.Sprintf("%s: %s", backend, err))
+	}
+	return nil, "", fmt.Errorf("No credential store is available (%s)", strings.Join(failures, "; "))
+}
+
+// openStoreBackend opens a single backend, failing when it is unavailable
+func openStoreBackend(config *configfile.ConfigFile, backend string, storeSettings storeConfig, prober *helperProber) (*dockerCredentials.Store, string, error) {
+	switch backend {
+	case fileBackend:
+		store, err := newSecondaryFileStore(config, newLockedFileStore(secondaryFileStorePath(config)))
+		return store, secondaryFileStorePath(config), err
+	case encryptedFileBackend:
+		key, err := loadStoreKey(secondaryFileStoreDir(config))
+		if err != nil {
+			return nil, "", err
+		}
+		if key == nil {
+			return nil, "", fmt.Errorf("no store key is configured")
+		}
+		store, err := newSecondaryFileStore(config, newEncryptedFileStore(encryptedFileStorePath(config), key))
+		return store, encryptedFileStorePath(config), err
+	default:
+		helperName := "docker-credential-" + backend
+		if err := prober.probe(helperName); err != nil {
+			return nil, "", err
+		}
+		var store dockerCredentials.Store = newHelperStore(backend)
+		if maxSize := storeSettings.maxSecretSize(backend); maxSize > 0 {
+			store = newChunkedStore(newHelperStore(backend), maxSize)
+		}
+		return &store, helperName, nil
+	}
+}
+
+// probeCredentialHelper checks that the helper is on the PATH and able to list
+// its credentials within the timeout. A helper that cannot reach its keyring,
+// such as secretservice without a D-Bus session, fails the probe.
+func probeCredentialHelper(helperName string, timeout time.Duration) error {
+	path, err := exec.LookPath(helperName)
+	if err != nil {
+		return fmt.Errorf("%s is not found", helperName)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	probe := exec.CommandContext(ctx, path, "list")
+	probe.Stdin = strings.NewReader("")
+	// helpers report errors on stdout
+	output, err := probe.CombinedOutput()
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s did not respond within %s", helperName, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s is unhealthy, %s: %s", helperName, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/cli/cli/config/configfile"
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// useFakeHelpers writes shell scripts named docker-credential-<name> into a
+// temporary directory that is put first on the PATH
+func useFakeHelpers(t *testing.T, scripts map[string]string) func() {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake credential helpers are shell scripts")
+	}
+	dir, err := ioutil.TempDir("", "acr-fake-helpers")
+	assert.NoError(t, err)
+	for name, script := range scripts {
+		err = ioutil.WriteFile(filepath.Join(dir, "docker-credential-"+name), []byte("#!/bin/sh\n"+script), 0700)
+		assert.NoError(t, err)
+	}
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+	return func() {
+		os.Setenv("PATH", oldPath)
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestDockerConfig(t *testing.T) (*configfile.ConfigFile, func()) {
+	dir, err := ioutil.TempDir("", "acr-docker-config")
+	assert.NoError(t, err)
+	config := &configfile.ConfigFile{
+		Filename:    filepath.Join(dir, "config.json"),
+		AuthConfigs: map[string]dockerTypes.AuthConfig{},
+	}
+	return config, func() { os.RemoveAll(dir) }
+}
+
+func TestSelectStoreBackend(t *testing.T) {
+	defer useFakeHelpers(t, map[string]string{
+		"healthy":   "echo '{}'\n",
+		"nodbus":    "echo 'Cannot autolaunch D-Bus without X11 $DISPLAY'\nexit 1\n",
+		"unhealthy": "exit 1\n",
+		"hanging":   "exec sleep 10\n",
+	})()
+	config, cleanup := newTestDockerConfig(t)
+	defer cleanup()
+	defer os.Setenv(envStoreKey, os.Getenv(envStoreKey))
+	os.Unsetenv(envStoreKey)
+	defer os.Setenv(envStoreKeyFile, os.Getenv(envStoreKeyFile))
+	os.Unsetenv(envStoreKeyFile)
+	defer os.Setenv(envStorePassphrase, os.Getenv(envStorePassphrase))
+	os.Unsetenv(envStorePassphrase)
+
+	testCases := []struct {
+		backends []string
+		expected string
+	}{
+		{[]string{"healthy", "file"}, "docker-credential-healthy"},
+		{[]string{"missing", "nodbus", "unhealthy", "healthy"}, "docker-credential-healthy"},
+		{[]string{"hanging", "file"}, secondaryFileStorePath(config)},
+		{[]string{"nodbus", "encrypted-file", "file"}, secondaryFileStorePath(config)},
+	}
+	for _, tc := range testCases {
+		_, backend, err := selectStoreBackend(config, storeConfig{Backends: tc.backends, ProbeTimeout: "200ms"}, true)
+		assert.NoError(t, err, "%v", tc.backends)
+		assert.Equal(t, tc.expected, backend, "%v", tc.backends)
+	}
+
+	_, _, err := selectStoreBackend(config, storeConfig{Backends: []string{"missing", "nodbus"}}, true)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "docker-credential-missing is not found")
+	assert.Contains(t, err.Error(), "D-Bus")
+
+	os.Setenv(envStorePassphrase, "passphrase")
+	_, backend, err := selectStoreBackend(config, storeConfig{Backends: []string{"nodbus", "encrypted-file", "file"}}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, encryptedFileStorePath(config), backend)
+}
+
+func TestProbeCredentialHelperTimeout(t *testing.T) {
+	defer useFakeHelpers(t, map[string]string{"hanging": "exec sleep 10\n"})()
+	start := time.Now()
+	err := probeCredentialHelper("docker-credential-hanging", 100*time.Millisecond)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "did not respond")
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestHelperProberCache(t *testing.T) {
+	config, cleanup := newTestDockerConfig(t)
+	defer cleanup()
+	probes := filepath.Join(filepath.Dir(config.Filename), "probes.log")
+	defer useFakeHelpers(t, map[string]string{
+		"counted": "echo probe >> " + probes + "\necho '{}'\n",
+		"broken":  "echo probe >> " + probes + "\nexit 1\n",
+	})()
+	probeCount := func() int {
+		content, _ := ioutil.ReadFile(probes)
+		return strings.Count(string(content), "probe")
+	}
+
+	prober, err := newHelperProber(config, storeConfig{}, false)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, prober.probe("docker-credential-counted"))
+		assert.Error(t, prober.probe("docker-credential-broken"))
+	}
+	assert.Equal(t, 2, probeCount())
+
+	prober.refresh = true
+	assert.NoError(t, prober.probe("docker-credential-counted"))
+	assert.Equal(t, 3, probeCount())
+
+	prober, err = newHelperProber(config, storeConfig{ProbeCacheTTL: "0s"}, false)
+	assert.NoError(t, err)
+	assert.NoError(t, prober.probe("docker-credential-counted"))
+	assert.NoError(t, prober.probe("docker-credential-counted"))
+	assert.Equal(t, 5, probeCount())
+
+	_, err = newHelperProber(config, storeConfig{ProbeCacheTTL: "-1m"}, false)
+	assert.Error(t, err)
+}
+
+func TestStoreConfigBackends(t *testing.T) {
+	defer os.Setenv(envStoreBackends, os.Getenv(envStoreBackends))
+	os.Setenv(envStoreBackends, " pass, ,file ")
+	config := storeConfig{Backends: []string{"secretservice"}}
+	config.applyEnvironment()
+	assert.Equal(t, []string{"pass", "file"}, config.backends())
+
+	defaults := (&storeConfig{}).backends()
+	assert.Equal(t, []string{encryptedFileBackend, fileBackend}, defaults[len(defaults)-2:])
+
+	_, err := (&storeConfig{ProbeTimeout: "soon"}).probeTimeout()
+	assert.Error(t, err)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// authChallenge is a single challenge of a Www-Authenticate header as defined
+// in RFC 7235 section 4.1. A challenge carries either a token68 or a list of
+// auth-params, whose names are case insensitive and stored in lower case.
+type authChallenge struct {
+	scheme  string
+	token68 string
+	params  map[string]string
+}
+
+// parseChallenges parses every instance of a Www-Authenticate header into the
+// list of challenges it contains, in the order they appear
+func parseChallenges(headers []string) ([]authChallenge, error) {
+	var challenges []authChallenge
+	for _, header := range headers {
+		parsed, err := parseChallengeHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		challenges = append(challenges, parsed...)
+	}
+	return challenges, nil
+}
+
+// findChallenge returns the first challenge with the given auth scheme
+func findChallenge(challenges []authChallenge, scheme string) *authChallenge {
+	for i := range challenges {
+		if strings.EqualFold(challenges[i].scheme, scheme) {
+			return &challenges[i]
+		}
+	}
+	return nil
+}
+
+// parseChallengeHeader parses a single header value of the form:
+// Bearer realm="https://example.com/oauth2/token", service=example.com, Basic abc==
+// Challenges and auth-params share the comma separator, a new challenge starts
+// whenever an element is not in the form of token = ( token / quoted-string )
+func parseChallengeHeader(header string) ([]authChallenge, error) {
+	p := &challengeParser{input: header}
+	var challenges []authChallenge
+	for {
+		p.skipListSeparators()
+		if p.eof() {
+			return challenges, nil
+		}
+		scheme := p.token()
+		if scheme == "" {
+			return nil, p.errorf("expected auth scheme")
+		}
+		challenge := authChallenge{
+			scheme: scheme,
+			params: make(map[string]string),
+		}
+
+		spaces := p.skipSpaces()
+		if !p.eof() && p.peek() != ',' {
+			if spaces == 0 {
+				return nil, p.errorf("expected space after auth scheme %s", scheme)
+			}
+			if err := p.parseChallengeBody(&challenge); err != nil {
+				return nil, err
+			}
+		}
+		challenges = append(challenges, challenge)
+	}
+}
+
+// challengeParser is a cursor over a single Www-Authenticate header value
+type challengeParser struct {
+	input  string
+	cursor int
+}
+
+func (p *challengeParser) eof() bool {
+	return p.cursor >= len(p.input)
+}
+
+func (p *challengeParser) peek() byte {
+	return p.input[p.cursor]
+}
+
+func (p *challengeParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("malformed header value at position %d: %s, header: %s",
+		p.cursor, fmt.Sprintf(format, args...), p.input)
+}
+
+// parseChallengeBody reads the token68 or the auth-params following the scheme
+func (p *challengeParser) parseChallengeBody(challenge *authChallenge) error {
+	name, value, isParam, err := p.authParam()
+	if err != nil {
+		return err
+	}
+	if !isParam {
+		challenge.token68 = p.token68()
+		if challenge.token68 == "" {
+			return p.errorf("expected token68 or auth-param")
+		}
+		p.skipSpaces()
+		if !p.eof() && p.peek() != ',' {
+			return p.errorf("unexpected character %q after token68", p.peek())
+		}
+		return nil
+	}
+
+	for {
+		if _, found := challenge.params[name]; found {
+			return p.errorf("duplicate auth-param %s", name)
+		}
+		challenge.params[name] = value
+
+		p.skipSpaces()
+		if p.eof() {
+			return nil
+		}
+		if p.peek() != ',' {
+			return p.errorf("expected comma, found %q", p.peek())
+		}
+
+		// the next element is either another auth-param of this challenge
+		// or the scheme of the next challenge
+		start := p.cursor
+		p.skipListSeparators()
+		if name, value, isParam, err = p.authParam(); err != nil {
+			return err
+		}
+		if !isParam {
+			p.cursor = start
+			return nil
+		}
+	}
+}
+
+// authParam reads token BWS "=" BWS ( token / quoted-string ). When the input
+// is not an auth-param the cursor is left untouched and isParam is false.
+func (p *challengeParser) authParam() (name string, value string, isParam bool, err error) {
+	start := p.cursor
+	if name = p.token(); name == "" {
+		return "", "", false, nil
+	}
+	p.skipSpaces()
+	if p.eof() || p.peek() != '=' {
+		p.cursor = start
+		return "", "", false, nil
+	}
+	p.cursor++
+	p.skipSpaces()
+	if !p.eof() && p.peek() == '"' {
+		if value, err = p.quotedString(); err != nil {
+			return "", "", false, err
+		}
+	} else if value = p.unquotedValue(); value == "" {
+		// could be a token68 with padding such as abc==
+		p.cursor = start
+		return "", "", false, nil
+	}
+	return strings.ToLower(name), value, true, nil
+}
+
+// quotedString reads a quoted-string and resolves its quoted-pairs
+func (p *challengeParser) quotedString() (string, error) {
+	start := p.cursor
+	p.cursor++
+	var value []byte
+	for !p.eof() {
+		c := p.peek()
+		p.cursor++
+		switch {
+		case c == '"':
+			return string(value), nil
+		case c == '\\':
+			if p.eof() {
+				p.cursor = start
+				return "", p.errorf("unterminated quoted-pair")
+			}
+			value = append(value, p.peek())
+			p.cursor++
+		case c < ' ' && c != '\t', c == 0x7f:
+			return "", p.errorf("invalid character %q in quoted-string", c)
+		default:
+			value = append(value, c)
+		}
+	}
+	p.cursor = start
+	return "", p.errorf("unterminated quoted-string")
+}
+
+func (p *challengeParser) token() string {
+	start := p.cursor
+	for !p.eof() && isTokenChar(p.peek()) {
+		p.cursor++
+	}
+	return p.input[start:p.cursor]
+}
+
+// unquotedValue reads an auth-param value that is not quoted. It is more
+// lenient than the token rule since some registries and proxies send URLs
+// unquoted, which contain characters such as ':' and '/' that are not tchars.
+func (p *challengeParser) unquotedValue() string {
+	start := p.cursor
+	if p.eof() || p.peek() == '=' {
+		return ""
+	}
+	for !p.eof() && strings.IndexByte(", \t\"", p.peek()) == -1 {
+		p.cursor++
+	}
+	return p.input[start:p.cursor]
+}
+
+func (p *challengeParser) token68() string {
+	start := p.cursor
+	for !p.eof() && isToken68Char(p.peek()) {
+		p.cursor++
+	}
+	if p.cursor == start {
+		return ""
+	}
+	for !p.eof() && p.peek() == '=' {
+		p.cursor++
+	}
+	return p.input[start:p.cursor]
+}
+
+func (p *challengeParser) skipSpaces() int {
+	start := p.cursor
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.cursor++
+	}
+	return p.cursor - start
+}
+
+// skipListSeparators skips whitespace and empty list elements
+func (p *challengeParser) skipListSeparators() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t' || p.peek() == ',') {
+		p.cursor++
+	}
+}
+
+// isTokenChar reports whether c is a tchar as defined in RFC 7230 section 3.2.6
+func isTokenChar(c byte) bool {
+	if isAlphaNumeric(c) {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1
+}
+
+// isToken68Char reports whether c may appear in a token68 before its padding
+func isToken68Char(c byte) bool {
+	if isAlphaNumeric(c) {
+		return true
+	}
+	return strings.IndexByte("-._~+/", c) != -1
+}
+
+func isAlphaNumeric(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseChallenges(t *testing.T) {
+	testCases := []struct {
+		name     string
+		headers  []string
+		expected []authChallenge
+		fails    bool
+	}{
+		{
+			name:    "acr bearer",
+			headers: []string{`Bearer realm="https://myregistry.azurecr.io/oauth2/token",service="myregistry.azurecr.io"`},
+			expected: []authChallenge{
+				{scheme: "Bearer", params: map[string]string{
+					"realm":   "https://myregistry.azurecr.io/oauth2/token",
+					"service": "myregistry.azurecr.io",
+				}},
+			},
+		},
+		{
+			name:    "unquoted values and spacing",
+			headers: []string{`bearer  Realm = https://example.com/token ,service=example.com`},
+			expected: []authChallenge{
+				{scheme: "bearer", params: map[string]string{"realm": "https://example.com/token", "service": "example.com"}},
+			},
+		},
+		{
+			name:    "escaped quotes",
+			headers: []string{`Bearer realm="https://example.com/token",error_description="say \"hello\" \\ bye"`},
+			expected: []authChallenge{
+				{scheme: "Bearer", params: map[string]string{"realm": "https://example.com/token", "error_description": `say "hello" \ bye`}},
+			},
+		},
+		{
+			name:    "comma inside quotes",
+			headers: []string{`Bearer realm="https://example.com/token",scope="repository:a:pull,push"`},
+			expected: []authChallenge{
+				{scheme: "Bearer", params: map[string]string{"realm": "https://example.com/token", "scope": "repository:a:pull,push"}},
+			},
+		},
+		{
+			name:    "empty quoted value",
+			headers: []string{`Bearer realm="https://example.com/token", service=""`},
+			expected: []authChallenge{
+				{scheme: "Bearer", params: map[string]string{"realm": "https://example.com/token", "service": ""}},
+			},
+		},
+		{
+			name:    "multiple challenges in one header",
+			headers: []string{`Basic realm="Registry Realm", Bearer realm="https://example.com/token",service="example.com"`},
+			expected: []authChallenge{
+				{scheme: "Basic", params: map[string]string{"realm": "Registry Realm"}},
+				{scheme: "Bearer", params: map[string]string{"realm": "https://example.com/token", "service": "example.com"}},
+			},
+		},
+		{
+			name:    "multiple header instances",
+			headers: []string{`Basic realm="proxy"`, `Bearer realm="https://example.com/token",service="example.com"`},
+			expected: []authChallenge{
+				{scheme: "Basic", params: map[string]string{"realm": "proxy"}},
+				{scheme: "Bearer", params: map[string]string{"realm": "https://example.com/token", "service": "example.com"}},
+			},
+		},
+		{
+			name:    "token68 with padding",
+			headers: []string{`Negotiate abc+/9==, Bearer realm=x`},
+			expected: []authChallenge{
+				{scheme: "Negotiate", token68: "abc+/9==", params: map[string]string{}},
+				{scheme: "Bearer", params: map[string]string{"realm": "x"}},
+			},
+		},
+		{
+			name:    "token68 with single padding",
+			headers: []string{`Negotiate abc=`},
+			expected: []authChallenge{
+				{scheme: "Negotiate", token68: "abc=", params: map[string]string{}},
+			},
+		},
+		{
+			name:    "scheme without parameters",
+			headers: []string{`Negotiate, Bearer realm="x"`},
+			expected: []authChallenge{
+				{scheme: "Negotiate", params: map[string]string{}},
+				{scheme: "Bearer", params: map[string]string{"realm": "x"}},
+			},
+		},
+		{
+			name:    "empty list elements",
+			headers: []string{` , Bearer realm="x",, service="y" ,`},
+			expected: []authChallenge{
+				{scheme: "Bearer", params: map[string]string{"realm": "x", "service": "y"}},
+			},
+		},
+		{
+			name:    "empty header",
+			headers: []string{``},
+		},
+		{
+			name:    "unterminated quote",
+			headers: []string{`Bearer realm="https://example.com/token,service="example.com`},
+			fails:   true,
+		},
+		{
+			name:    "trailing escape",
+			headers: []string{`Bearer realm="abc\`},
+			fails:   true,
+		},
+		{
+			name:    "missing comma between parameters",
+			headers: []string{`Bearer realm="x" service="y"`},
+			fails:   true,
+		},
+		{
+			name:    "duplicate parameter",
+			headers: []string{`Bearer realm="x", realm="y"`},
+			fails:   true,
+		},
+		{
+			name:    "missing scheme",
+			headers: []string{`="x"`},
+			fails:   true,
+		},
+		{
+			name:    "missing space after scheme",
+			headers: []string{`Bearer"realm"`},
+			fails:   true,
+		},
+		{
+			name:    "garbage after token68",
+			headers: []string{`Negotiate abc== def`},
+			fails:   true,
+		},
+		{
+			name:    "control character in quoted string",
+			headers: []string{"Bearer realm=\"a\x01b\""},
+			fails:   true,
+		},
+		{
+			name:    "one bad header instance",
+			headers: []string{`Bearer realm="x"`, `Basic realm="`},
+			fails:   true,
+		},
+	}
+	for _, tc := range testCases {
+		actual, err := parseChallenges(tc.headers)
+		if tc.fails {
+			assert.Error(t, err, tc.name)
+			continue
+		}
+		if !assert.NoError(t, err, tc.name) {
+			continue
+		}
+		assert.Equal(t, tc.expected, actual, fmt.Sprintf("%s: %v", tc.name, tc.headers))
+	}
+}
+
+func TestFindChallenge(t *testing.T) {
+	challenges, err := parseChallenges([]string{`Basic realm="x"`, `bearer realm="y",service="z"`})
+	assert.NoError(t, err)
+
+	bearer := findChallenge(challenges, "Bearer")
+	if assert.NotNil(t, bearer) {
+		assert.Equal(t, "y", bearer.params["realm"])
+	}
+	assert.Nil(t, findChallenge(challenges, "Negotiate"))
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	dockerCredentials "github.com/docker/cli/cli/config/credentials"
+	dockerTypes "github.com/docker/docker/api/types"
+)
+
+const (
+	// chunkedSecretPrefix marks the secret of an entry whose actual secret is
+	// split across chunk entries, it is followed by the number of chunks
+	chunkedSecretPrefix = "docker-credential-acr-chunks:"
+	// chunkKeySeparator joins the server address and the number of a chunk
+	// into the server address of the chunk entry. It is a path segment, since
+	// helpers such as osxkeychain parse the address as a URL and keep only its
+	// host and path.
+	chunkKeySeparator = "/chunk-"
+)
+
+// helperSecretSizeLimits are the known secret size limits of credential helpers
+var helperSecretSizeLimits = map[string]int{
+	// CRED_MAX_CREDENTIAL_BLOB_SIZE of the Windows Credential Manager
+	"wincred": 2560,
+}
+
+// chunkedStore splits secrets larger than maxSize across numbered chunk
+// entries of the credential helper, for helpers that cannot hold ACR tokens in
+// a single entry. The entry of the server then holds the number of chunks in
+// place of the secret, and chunk i is stored under <server>/chunk-<i>. The
+// entries go to the helper alone, so the docker config file never lists the
+// chunks as registries, and they are hidden from GetAll.
+type chunkedStore struct {
+	store   *helperStore
+	maxSize int
+}
+
+func newChunkedStore(store *helperStore, maxSize int) dockerCredentials.Store {
+	return &chunkedStore{store: store, maxSize: maxSize}
+}
+
+func (s *chunkedStore) Erase(serverAddress string) error {
+	auth, err := s.store.Get(serverAddress)
+	if err != nil {
+		return err
+	}
+	if err = s.store.Erase(serverAddress); err != nil {
+		return err
+	}
+	count, _ := parseChunkedSecret(secretOf(auth))
+	return s.eraseChunks(serverAddress, 1, count)
+}
+
+func (s *chunkedStore) Get(serverAddress string) (dockerTypes.AuthConfig, error) {
+	auth, err := s.store.Get(serverAddress)
+	if err != nil {
+		return auth, err
+	}
+	count, chunked := parseChunkedSecret(secretOf(auth))
+	if !chunked {
+		return auth, nil
+	}
+	chunks := make([]string, count)
+	for i := range chunks {
+		chunk, err := s.store.Get(chunkKey(serverAddress, i+1))
+		if err != nil {
+			return auth, err
+		}
+		chunks[i] = secretOf(chunk)
+	}
+	return joinChunks(serverAddress, auth, chunks)
+}
+
+func (s *chunkedStore) GetAll() (map[string]dockerTypes.AuthConfig, error) {
+	auths, err := s.store.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]dockerTypes.AuthConfig)
+	for server, auth := range auths {
+		if _, chunked := parseChunkedSecret(secretOf(auth)); chunked {
+			if auth, err = s.Get(server); err != nil {
+				return nil, err
+			}
+		}
+		result[server] = auth
+	}
+	return result, nil
+}
+
+func (s *chunkedStore) Store(authConfig dockerTypes.AuthConfig) error {
+	serverAddress := authConfig.ServerAddress
+	previous, err := s.store.Get(serverAddress)
+	if err != nil {
+		return err
+	}
+	previousCount, _ := parseChunkedSecret(secretOf(previous))
+
+	chunks := splitSecret(secretOf(authConfig), s.maxSize)
+	if len(chunks) > 1 {
+		header := chunkedSecretPrefix + strconv.Itoa(len(chunks))
+		if len(header) > s.maxSize {
+			return fmt.Errorf("Unable to store the credentials for %s, secrets are limited to %d bytes", serverAddress, s.maxSize)
+		}
+		for i, chunk := range chunks {
+			chunkConfig := withSecret(authConfig, chunk)
+			chunkConfig.ServerAddress = chunkKey(serverAddress, i+1)
+			if err = s.store.Store(chunkConfig); err != nil {
+				return fmt.Errorf("Failed to store chunk %d of %d of the credentials for %s, error: %s", i+1, len(chunks), serverAddress, err)
+			}
+		}
+		authConfig = withSecret(authConfig, header)
+	} else {
+		chunks = nil
+	}
+	if err = s.store.Store(authConfig); err != nil {
+		return err
+	}
+	return s.eraseChunks(serverAddress, len(chunks)+1, previousCount)
+}
+
+// eraseChunks erases the chunks from first to last of a server
+func (s *chunkedStore) eraseChunks(serverAddress string, first int, last int) error {
+	for i := first; i <= last; i++ {
+		if err := s.store.Erase(chunkKey(serverAddress, i)); err != nil {
+			return fmt.Errorf("Failed to erase chunk %d of the credentials for %s, error: %s", i, serverAddress, err)
+		}
+	}
+	return nil
+}
+
+func chunkKey(serverAddress string, i int) string {
+	return serverAddress + chunkKeySeparator + strconv.Itoa(i)
+}
+
+func isChunkKey(serverAddress string) bool {
+	separator := strings.LastIndex(serverAddress, chunkKeySeparator)
+	if separator == -1 {
+		return false
+	}
+	_, err := strconv.Atoi(serverAddress[separator+len(chunkKeySeparator):])
+	return err == nil
+}
+
+// parseChunkedSecret returns the number of chunks of a chunked secret
+func parseChunkedSecret(secret string) (int, bool) {
+	if !strings.HasPrefix(secret, chunkedSecretPrefix) {
+		return 0, false
+	}
+	count, err := strconv.Atoi(strings.TrimPrefix(secret, chunkedSecretPrefix))
+	if err != nil || count < 1 {
+		return 0, false
+	}
+	return count, true
+}
+
+// splitSecret splits a secret into chunks of at most maxSize bytes, without
+// splitting UTF-8 encoded characters
+func splitSecret(secret string, maxSize int) []string {
+	var chunks []string
+	for len(secret) > maxSize {
+		size := maxSize
+		for size > 1 && !utf8.RuneStart(secret[size]) {
+			size--
+		}
+		chunks = append(chunks, secret[:size])
+		secret = secret[size:]
+	}
+	return append(chunks, secret)
+}
+
+func joinChunks(serverAddress string, auth dockerTypes.AuthConfig, chunks []string) (dockerTypes.AuthConfig, error) {
+	for i, chunk := range chunks {
+		if chunk == "" {
+			return auth, fmt.Errorf("Chunk %d of %d of the credentials for %s is missing", i+1, len(chunks), serverAddress)
+		}
+	}
+	return withSecret(auth, strings.Join(chunks, "")), nil
+}
+
+// secretOf returns the identity token or the password of the credentials
+func secretOf(auth dockerTypes.AuthConfig) string {
+	if auth.IdentityToken != "" {
+		return auth.IdentityToken
+	}
+	return auth.Password
+}
+
+// withSecret replaces the identity token or the password of the credentials
+func withSecret(auth dockerTypes.AuthConfig, secret string) dockerTypes.AuthConfig {
+	if auth.IdentityToken != "" {
+		auth.IdentityToken = secret
+	} else {
+		auth.Password = secret
+	}
+	return auth
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	helperCredentials "github.com/docker/docker-credential-helpers/credentials"
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	envFakeHelperDir           = "TEST_FAKE_HELPER_DIR"
+	envFakeHelperMaxSecretSize = "TEST_FAKE_HELPER_MAX_SECRET_SIZE"
+)
+
+// TestMain runs the test binary as a fake credential helper when it is
+// invoked through a script written by useSizeLimitedHelper
+func TestMain(m *testing.M) {
+	if dir := os.Getenv(envFakeHelperDir); dir != "" {
+		maxSecretSize, _ := strconv.Atoi(os.Getenv(envFakeHelperMaxSecretSize))
+		helperCredentials.Serve(&fakeHelper{dir: dir, maxSecretSize: maxSecretSize})
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeHelper is a credential helper keeping each credential in a file of its
+// directory, which rejects secrets larger than maxSecretSize
+type fakeHelper struct {
+	dir           string
+	maxSecretSize int
+}
+
+func (h *fakeHelper) path(serverURL string) string {
+	return filepath.Join(h.dir, hex.EncodeToString([]byte(serverURL)))
+}
+
+func (h *fakeHelper) Add(creds *helperCredentials.Credentials) error {
+	if len(creds.Secret) > h.maxSecretSize {
+		return fmt.Errorf("secret of %d bytes exceeds the limit of %d bytes", len(creds.Secret), h.maxSecretSize)
+	}
+	content, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(h.path(creds.ServerURL), content, 0600)
+}
+
+func (h *fakeHelper) Delete(serverURL string) error {
+	if err := os.Remove(h.path(serverURL)); os.IsNotExist(err) {
+		return helperCredentials.NewErrCredentialsNotFound()
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (h *fakeHelper) Get(serverURL string) (string, string, error) {
+	content, err := ioutil.ReadFile(h.path(serverURL))
+	if os.IsNotExist(err) {
+		return "", "", helperCredentials.NewErrCredentialsNotFound()
+	} else if err != nil {
+		return "", "", err
+	}
+	var creds helperCredentials.Credentials
+	if err = json.Unmarshal(content, &creds); err != nil {
+		return "", "", err
+	}
+	return creds.Username, creds.Secret, nil
+}
+
+func (h *fakeHelper) List() (map[string]string, error) {
+	files, err := ioutil.ReadDir(h.dir)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string)
+	for _, file := range files {
+		serverURL, err := hex.DecodeString(file.Name())
+		if err != nil {
+			continue
+		}
+		username, _, err := h.Get(string(serverURL))
+		if err != nil {
+			return nil, err
+		}
+		result[string(serverURL)] = username
+	}
+	return result, nil
+}
+
+// useSizeLimitedHelper installs docker-credential-sizelimited, a fake helper
+// rejecting secrets larger than maxSecretSize, and returns the directory its
+// entries are kept in
+func useSizeLimitedHelper(t *testing.T, maxSecretSize int) (string, func()) {
+	dir, err := ioutil.TempDir("", "acr-fake-helper-entries")
+	assert.NoError(t, err)
+	script := fmt.Sprintf("%s=%s %s=%d exec %s \"$@\"\n",
+		envFakeHelperDir, dir, envFakeHelperMaxSecretSize, maxSecretSize, os.Args[0])
+	restore := useFakeHelpers(t, map[string]string{"sizelimited": script})
+	return dir, func() {
+		restore()
+		os.RemoveAll(dir)
+	}
+}
+
+func entryCount(t *testing.T, dir string) int {
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	return len(files)
+}
+
+func TestSizeLimitedHelperRejectsLargeSecrets(t *testing.T) {
+	_, restore := useSizeLimitedHelper(t, 1000)
+	defer restore()
+
+	store := newHelperStore("sizelimited")
+	err := store.Store(dockerTypes.AuthConfig{
+		ServerAddress: "myregistry.azurecr.io",
+		IdentityToken: strings.Repeat("t", 1001),
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "exceeds the limit")
+}
+
+func TestChunkedStore(t *testing.T) {
+	dir, restore := useSizeLimitedHelper(t, 1000)
+	defer restore()
+	store := newChunkedStore(newHelperStore("sizelimited"), 1000)
+	server := "myregistry.azurecr.io"
+
+	testCases := []struct {
+		size    int
+		entries int
+	}{
+		{4500, 6},
+		{1500, 3},
+		{1000, 1},
+		{2001, 4},
+	}
+	for _, tc := range testCases {
+		token := strings.Repeat("t", tc.size-1) + "!"
+		assert.NoError(t, store.Store(dockerTypes.AuthConfig{ServerAddress: server, IdentityToken: token}), "size %d", tc.size)
+		assert.Equal(t, tc.entries, entryCount(t, dir), "size %d", tc.size)
+
+		auth, err := store.Get(server)
+		assert.NoError(t, err)
+		assert.Equal(t, token, auth.IdentityToken, "size %d", tc.size)
+
+		auths, err := store.GetAll()
+		assert.NoError(t, err)
+		assert.Len(t, auths, 1)
+		assert.Equal(t, token, auths[server].IdentityToken, "size %d", tc.size)
+	}
+
+	assert.NoError(t, store.Erase(server))
+	assert.Equal(t, 0, entryCount(t, dir))
+	auth, err := store.Get(server)
+	assert.NoError(t, err)
+	assert.Empty(t, auth.IdentityToken)
+}
+
+func TestChunkedStorePasswords(t *testing.T) {
+	_, restore := useSizeLimitedHelper(t, 41)
+	defer restore()
+	store := newChunkedStore(newHelperStore("sizelimited"), 41)
+
+	password := strings.Repeat("pässwörd", 12)
+	assert.NoError(t, store.Store(dockerTypes.AuthConfig{ServerAddress: "docker.io", Username: "user", Password: password}))
+	auth, err := store.Get("docker.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "user", auth.Username)
+	assert.Equal(t, password, auth.Password)
+}
+
+func TestChunkedStoreMissingChunk(t *testing.T) {
+	dir, restore := useSizeLimitedHelper(t, 40)
+	defer restore()
+	store := newChunkedStore(newHelperStore("sizelimited"), 40)
+
+	assert.NoError(t, store.Store(dockerTypes.AuthConfig{ServerAddress: "docker.io", IdentityToken: strings.Repeat("t", 100)}))
+	assert.NoError(t, os.Remove((&fakeHelper{dir: dir}).path(chunkKey("docker.io", 2))))
+	_, err := store.Get("docker.io")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Chunk 2 of 3")
+	}
+}
+
+func TestChunkedStoreLeavesDockerConfigUntouched(t *testing.T) {
+	dir, restore := useSizeLimitedHelper(t, 1000)
+	defer restore()
+	config, cleanup := newTestDockerConfigFile(t)
+	defer cleanup()
+	store, _, err := selectStoreBackend(config, storeConfig{
+		Backends:      []string{"sizelimited"},
+		MaxSecretSize: map[string]int{"sizelimited": 1000},
+	}, false)
+	assert.NoError(t, err)
+	server := "myregistry.azurecr.io"
+
+	token := strings.Repeat("t", 2500)
+	assert.NoError(t, (*store).Store(dockerTypes.AuthConfig{ServerAddress: server, IdentityToken: token}))
+	assert.Equal(t, 4, entryCount(t, dir))
+	assertDockerConfigUntouched(t, config)
+
+	servers, err := (&storeWrapper{store: store}).List()
+	assert.NoError(t, err)
+	assert.Len(t, servers, 1)
+	assert.Contains(t, servers, server)
+	auths, err := newHelperStore("sizelimited").GetAll()
+	assert.NoError(t, err)
+	assert.Len(t, auths, 1)
+
+	assert.NoError(t, (*store).Erase(server))
+	assert.Equal(t, 0, entryCount(t, dir))
+	assertDockerConfigUntouched(t, config)
+}
+
+func TestSplitSecret(t *testing.T) {
+	assert.Equal(t, []string{"abc"}, splitSecret("abc", 3))
+	assert.Equal(t, []string{"abc", "d"}, splitSecret("abcd", 3))
+	assert.Equal(t, []string{"a", "é", "b"}, splitSecret("aéb", 2))
+}
+
+func TestChunkKey(t *testing.T) {
+	assert.True(t, isChunkKey(chunkKey("myregistry.azurecr.io", 12)))
+	assert.False(t, isChunkKey("myregistry.azurecr.io"))
+	assert.False(t, isChunkKey("myregistry.azurecr.io/chunk-a"))
+
+	// osxkeychain keys its items by the host and path of the server URL, which
+	// must differ between the entry of a server and its chunks
+	for _, server := range []string{"myregistry.azurecr.io", "https://index.docker.io/v1/"} {
+		keys := make(map[string]bool)
+		for _, key := range []string{server, chunkKey(server, 1), chunkKey(server, 2)} {
+			if !strings.Contains(key, "://") {
+				key = "https://" + key
+			}
+			parsed, err := url.Parse(key)
+			assert.NoError(t, err, key)
+			keys[parsed.Host+parsed.Path] = true
+		}
+		assert.Len(t, keys, 3, server)
+	}
+}
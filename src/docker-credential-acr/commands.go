@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+
+	"github.com/spf13/cobra"
+)
+
+// newAdminCommand builds the commands that inspect and maintain the stored
+// credentials. Docker itself only ever invokes the store, get, erase and list
+// actions, which are served by the credential helper protocol instead. The
+// commands print their results to out.
+func newAdminCommand(wrapper *storeWrapper, out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "docker-credential-acr",
+		Short: "Docker credential helper for Azure Container Registry.",
+		Long: "Docker credential helper for Azure Container Registry.\n\n" +
+			"The credentials are kept next to the docker config file in the directory given with --config, " +
+			"DOCKER_CONFIG or .docker in the home directory.",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	cmd.AddCommand(newStatusCommand(wrapper, out))
+	cmd.AddCommand(newRefreshAllCommand(wrapper, out))
+	cmd.AddCommand(newRekeyCommand(wrapper, out))
+	cmd.AddCommand(newMigrateCommand(wrapper, out))
+	return cmd
+}
+
+// isAdminCommand reports whether the arguments name one of the subcommands of
+// the admin command rather than a credential helper action
+func isAdminCommand(cmd *cobra.Command, args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	found, _, err := cmd.Find(args)
+	return err == nil && found != cmd
+}
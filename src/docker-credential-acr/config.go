@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	cliconfig "github.com/docker/cli/cli/config"
+)
+
+// helperConfig holds the settings of the credential helper. It is read from
+// the file named by DOCKER_CREDENTIAL_ACR_CONFIG, or from acr/helper.json in
+// the docker config directory.
+//
+//	{
+//		"registries": {
+//			"myregistry.azurecr.io": {
+//				"exchangeEndpoint": "https://myregistry.privatelink.azurecr.io/oauth2/exchange"
+//			}
+//		},
+//		"http": {
+//			"timeout": "30s",
+//			"caFile": "/etc/ssl/certs/corporate-ca.pem"
+//		},
+//		"retry": {
+//			"maxAttempts": 3,
+//			"minBackoff": "200ms",
+//			"maxBackoff": "5s"
+//		},
+//		"store": {
+//			"backends": ["pass", "encrypted-file", "file"]
+//		}
+//	}
+type helperConfig struct {
+	Registries map[string]registryConfig `json:"registries,omitempty"`
+	HTTP       httpConfig                `json:"http,omitempty"`
+	Retry      retryConfig               `json:"retry,omitempty"`
+	Store      storeConfig               `json:"store,omitempty"`
+}
+
+// registryConfig holds the settings that apply to a single registry
+type registryConfig struct {
+	// ExchangeEndpoint overrides the token exchange endpoint derived from the
+	// challenge realm
+	ExchangeEndpoint string `json:"exchangeEndpoint,omitempty"`
+}
+
+const (
+	envHelperConfig  = "DOCKER_CREDENTIAL_ACR_CONFIG"
+	helperConfigDir  = "acr"
+	helperConfigFile = "helper.json"
+)
+
+// settings is the configuration in effect, loaded once in main
+var settings = &helperConfig{}
+
+func helperConfigPath() string {
+	if path := os.Getenv(envHelperConfig); path != "" {
+		return path
+	}
+	return filepath.Join(cliconfig.Dir(), helperConfigDir, helperConfigFile)
+}
+
+// loadHelperConfig reads the helper configuration, a missing file results in
+// the default configuration. Settings from the environment take precedence.
+func loadHelperConfig(path string) (*helperConfig, error) {
+	config := &helperConfig{}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			config.HTTP.applyEnvironment()
+			config.Store.applyEnvironment()
+			return config, nil
+		}
+		return nil, fmt.Errorf("Error reading helper config %s, error: %s", path, err)
+	}
+	if err = json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("Error parsing helper config %s, error: %s", path, err)
+	}
+	normalized := make(map[string]registryConfig)
+	for server, registry := range config.Registries {
+		normalized[registryHost(server)] = registry
+	}
+	config.Registries = normalized
+	config.HTTP.applyEnvironment()
+	config.Store.applyEnvironment()
+	return config, nil
+}
+
+// registry returns the settings for a registry, or the defaults if the
+// registry has none
+func (c *helperConfig) registry(serverAddress string) registryConfig {
+	return c.Registries[registryHost(serverAddress)]
+}
+
+// registryHost reduces a server address such as https://myregistry.azurecr.io/v2/
+// to the lower cased host and optional port
+func registryHost(serverAddress string) string {
+	host := serverAddress
+	if serverURL, err := url.Parse(serverAddress); err == nil && serverURL.Host != "" {
+		host = serverURL.Host
+	} else if slash := strings.Index(host, "/"); slash != -1 {
+		host = host[:slash]
+	}
+	return strings.ToLower(host)
+}
+
+// registryHostname is the registry host without the port
+func registryHostname(serverAddress string) string {
+	host := registryHost(serverAddress)
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		return hostname
+	}
+	return host
+}
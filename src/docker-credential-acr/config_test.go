@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadHelperConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acr-helper-config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config, err := loadHelperConfig(filepath.Join(dir, "missing.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, registryConfig{}, config.registry("myregistry.azurecr.io"))
+
+	path := filepath.Join(dir, "helper.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{
+		"registries": {
+			"MyRegistry.azurecr.io": {"exchangeEndpoint": "https://example.com/oauth2/exchange"}
+		}
+	}`), 0600))
+	config, err = loadHelperConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/oauth2/exchange", config.registry("https://myregistry.azurecr.io/v2/").ExchangeEndpoint)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"registries": [`), 0600))
+	_, err = loadHelperConfig(path)
+	assert.Error(t, err)
+}
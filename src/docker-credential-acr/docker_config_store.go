@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/docker/cli/cli/config/configfile"
+	dockerCredentials "github.com/docker/cli/cli/config/credentials"
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/ioutils"
+)
+
+// dockerConfigStore reads the auths of the docker config file, where docker
+// keeps credentials without a helper. The file store of docker saves the whole
+// config file on Erase, which drops the members the vendored configfile does
+// not know, such as proxies or currentContext. Erase removes the auths entry
+// from the file in place instead, leaving everything else as it was.
+type dockerConfigStore struct {
+	config *configfile.ConfigFile
+}
+
+func newDockerConfigStore(config *configfile.ConfigFile) *dockerConfigStore {
+	return &dockerConfigStore{config: config}
+}
+
+func (s *dockerConfigStore) Erase(serverAddress string) error {
+	content, err := ioutil.ReadFile(s.config.Filename)
+	if os.IsNotExist(err) {
+		delete(s.config.AuthConfigs, serverAddress)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	edited, err := removeConfigAuth(content, serverAddress)
+	if err != nil {
+		return fmt.Errorf("Unable to edit docker config %s, error: %s", s.config.Filename, err)
+	}
+	delete(s.config.AuthConfigs, serverAddress)
+	if bytes.Equal(content, edited) {
+		return nil
+	}
+	// keep the permissions of the config file, which may hold credentials
+	var mode os.FileMode = 0600
+	if fileInfo, err := os.Stat(s.config.Filename); err == nil {
+		mode = fileInfo.Mode().Perm()
+	}
+	return ioutils.AtomicWriteFile(s.config.Filename, edited, mode)
+}
+
+func (s *dockerConfigStore) Get(serverAddress string) (dockerTypes.AuthConfig, error) {
+	return dockerCredentials.NewFileStore(s.config).Get(serverAddress)
+}
+
+func (s *dockerConfigStore) GetAll() (map[string]dockerTypes.AuthConfig, error) {
+	return dockerCredentials.NewFileStore(s.config).GetAll()
+}
+
+// Store refuses to write credentials, docker keeps its config file up to date
+func (s *dockerConfigStore) Store(authConfig dockerTypes.AuthConfig) error {
+	return fmt.Errorf("Credentials can only be migrated from %s, not to it", dockerConfigBackend)
+}
+
+// removeConfigAuth removes the auths entries of the server from the content of
+// a docker config file, keeping the order and formatting of everything else
+func removeConfigAuth(content []byte, serverAddress string) ([]byte, error) {
+	// the parser only records spans, so the content is checked to be valid first
+	var value interface{}
+	if err := json.Unmarshal(content, &value); err != nil {
+		return nil, err
+	}
+	for {
+		parser := &jsonParser{content: content}
+		root, err := parser.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if !root.isObject {
+			return nil, fmt.Errorf("the config is not a JSON object")
+		}
+		auths := root.member("auths")
+		if auths == nil || !auths.value.isObject {
+			return content, nil
+		}
+		// encoding/json keeps the last of duplicate members, remove all of them
+		parent := auths.value
+		index := parent.memberIndex(serverAddress)
+		switch {
+		case index == -1:
+			return content, nil
+		case len(parent.members) == 1:
+			content = splice(content, parent.start+1, parent.end-1)
+		case index < len(parent.members)-1:
+			content = splice(content, parent.members[index].keyStart, parent.members[index+1].keyStart)
+		default:
+			content = splice(content, parent.members[index-1].value.end, parent.members[index].value.end)
+		}
+	}
+}
+
+// splice returns the content without the bytes from start to end
+func splice(content []byte, start int, end int) []byte {
+	spliced := make([]byte, 0, len(content)-(end-start))
+	spliced = append(spliced, content[:start]...)
+	return append(spliced, content[end:]...)
+}
+
+// jsonNode is the span of a JSON value in a document, along with the members
+// of an object. It follows the config document of config-edit.
+type jsonNode struct {
+	start    int
+	end      int
+	isObject bool
+	members  []jsonMember
+}
+
+// jsonMember is a member of an object, keyStart is the offset of the quoted key
+type jsonMember struct {
+	key      string
+	keyStart int
+	keyEnd   int
+	value    *jsonNode
+}
+
+// member returns the last member with the key, as encoding/json would
+func (n *jsonNode) member(key string) *jsonMember {
+	if index := n.memberIndex(key); index != -1 {
+		return &n.members[index]
+	}
+	return nil
+}
+
+func (n *jsonNode) memberIndex(key string) int {
+	for i := len(n.members) - 1; i >= 0; i-- {
+		if n.members[i].key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// jsonParser records the spans of the values of a document that is known to
+// be valid JSON
+type jsonParser struct {
+	content []byte
+	pos     int
+}
+
+func (p *jsonParser) skipSpace() {
+	for p.pos < len(p.content) {
+		switch p.content[p.pos] {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *jsonParser) parseValue() (*jsonNode, error) {
+	p.skipSpace()
+	if p.pos >= len(p.content) {
+		return nil, fmt.Errorf("unexpected end of JSON input")
+	}
+	node := &jsonNode{start: p.pos}
+	switch p.content[p.pos] {
+	case '{':
+		node.isObject = true
+		p.pos++
+		for {
+			p.skipSpace()
+			if p.pos < len(p.content) && p.content[p.pos] == '}' {
+				break
+			}
+			if p.pos < len(p.content) && p.content[p.pos] == ',' {
+				p.pos++
+				p.skipSpace()
+			}
+			member := jsonMember{keyStart: p.pos}
+			if err := p.skipString(); err != nil {
+				return nil, err
+			}
+			member.keyEnd = p.pos
+			if err := json.Unmarshal(p.content[member.keyStart:member.keyEnd], &member.key); err != nil {
+				return nil, err
+			}
+			p.skipSpace()
+			if p.pos >= len(p.content) || p.content[p.pos] != ':' {
+				return nil, fmt.Errorf("expected a colon at offset %d", p.pos)
+			}
+			p.pos++
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			member.value = value
+			node.members = append(node.members, member)
+		}
+		p.pos++
+	case '[':
+		p.pos++
+		for {
+			p.skipSpace()
+			if p.pos < len(p.content) && p.content[p.pos] == ']' {
+				break
+			}
+			if p.pos < len(p.content) && p.content[p.pos] == ',' {
+				p.pos++
+			}
+			if _, err := p.parseValue(); err != nil {
+				return nil, err
+			}
+		}
+		p.pos++
+	case '"':
+		if err := p.skipString(); err != nil {
+			return nil, err
+		}
+	default:
+		for p.pos < len(p.content) && !strings.ContainsRune(" \t\r\n,]}", rune(p.content[p.pos])) {
+			p.pos++
+		}
+	}
+	node.end = p.pos
+	return node, nil
+}
+
+func (p *jsonParser) skipString() error {
+	if p.pos >= len(p.content) || p.content[p.pos] != '"' {
+		return fmt.Errorf("expected a string at offset %d", p.pos)
+	}
+	for p.pos++; p.pos < len(p.content); p.pos++ {
+		switch p.content[p.pos] {
+		case '\\':
+			p.pos++
+		case '"':
+			p.pos++
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected end of JSON input")
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The encrypted file store keeps the credentials in acr/credentials.enc,
+// sealed with AES-256-GCM. The key is taken from, in order of precedence:
+// DOCKER_CREDENTIAL_ACR_STORE_KEY, a base64 encoded 32 byte key;
+// the key file named by DOCKER_CREDENTIAL_ACR_STORE_KEY_FILE or acr/store.key,
+// holding such a key and only accessible by its owner;
+// DOCKER_CREDENTIAL_ACR_STORE_PASSPHRASE, from which the key is derived with
+// PBKDF2-HMAC-SHA256 and a random salt kept in the encrypted file.
+const (
+	envStoreKey           = "DOCKER_CREDENTIAL_ACR_STORE_KEY"
+	envStoreKeyFile       = "DOCKER_CREDENTIAL_ACR_STORE_KEY_FILE"
+	envStorePassphrase    = "DOCKER_CREDENTIAL_ACR_STORE_PASSPHRASE"
+	envStoreNewPassphrase = "DOCKER_CREDENTIAL_ACR_STORE_NEW_PASSPHRASE"
+
+	storeKeyFile       = "store.key"
+	encryptedStoreFile = "credentials.enc"
+
+	storeKeySize            = 32
+	encryptedStoreVersion   = 1
+	passphraseKDF           = "pbkdf2-sha256"
+	passphraseKDFIterations = 200000
+	passphraseSaltSize      = 16
+)
+
+// storeKey is either a raw key or a passphrase to derive the key from
+type storeKey struct {
+	key        []byte
+	passphrase string
+}
+
+// loadStoreKey reads the key of the encrypted file store from the environment
+// or the key file in the given directory. It returns nil when no key is
+// configured, in which case the encrypted file store is not used.
+func loadStoreKey(dir string) (*storeKey, error) {
+	if encoded := os.Getenv(envStoreKey); encoded != "" {
+		key, err := decodeStoreKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", envStoreKey, err)
+		}
+		return &storeKey{key: key}, nil
+	}
+	keyFile := os.Getenv(envStoreKeyFile)
+	if keyFile == "" {
+		keyFile = filepath.Join(dir, storeKeyFile)
+		if _, err := os.Stat(keyFile); os.IsNotExist(err) {
+			keyFile = ""
+		}
+	}
+	if keyFile != "" {
+		return readStoreKeyFile(keyFile)
+	}
+	if passphrase := os.Getenv(envStorePassphrase); passphrase != "" {
+		return &storeKey{passphrase: passphrase}, nil
+	}
+	return nil, nil
+}
+
+// readStoreKeyFile reads a base64 encoded key from a file that must only be
+// accessible by its owner
+func readStoreKeyFile(path string) (*storeKey, error) {
+	if err := checkPrivatePermissions(path); err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading store key file %s, error: %s", path, err)
+	}
+	key, err := decodeStoreKey(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid store key file %s: %s", path, err)
+	}
+	return &storeKey{key: key}, nil
+}
+
+// generateStoreKeyFile writes a new random key to a file only accessible by
+// its owner. An existing file is not overwritten.
+func generateStoreKeyFile(path string) (*storeKey, error) {
+	key := make([]byte, storeKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("Error generating store key, error: %s", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating store key file %s, error: %s", path, err)
+	}
+	_, err = fmt.Fprintln(file, base64.StdEncoding.EncodeToString(key))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error writing store key file %s, error: %s", path, err)
+	}
+	return &storeKey{key: key}, nil
+}
+
+func decodeStoreKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("the key is not base64 encoded")
+	}
+	if len(key) != storeKeySize {
+		return nil, fmt.Errorf("the key must be %d bytes long, found %d", storeKeySize, len(key))
+	}
+	return key, nil
+}
+
+// encryptedFile is the content of the encrypted file store on disk
+type encryptedFile struct {
+	Version int `json:"version"`
+	// KDF describes how the key was derived from a passphrase, if it was
+	KDF        *kdfParams `json:"kdf,omitempty"`
+	Nonce      []byte     `json:"nonce"`
+	Ciphertext []byte     `json:"ciphertext"`
+}
+
+type kdfParams struct {
+	Name       string `json:"name"`
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations"`
+}
+
+// encryptingCodec seals the content of a locked file store with AES-256-GCM
+type encryptingCodec struct {
+	key *storeKey
+}
+
+func (c *encryptingCodec) encode(plaintext []byte) ([]byte, error) {
+	file := encryptedFile{Version: encryptedStoreVersion}
+	key := c.key.key
+	if key == nil {
+		file.KDF = &kdfParams{
+			Name:       passphraseKDF,
+			Salt:       make([]byte, passphraseSaltSize),
+			Iterations: passphraseKDFIterations,
+		}
+		if _, err := io.ReadFull(rand.Reader, file.KDF.Salt); err != nil {
+			return nil, err
+		}
+		key = pbkdf2SHA256([]byte(c.key.passphrase), file.KDF.Salt, file.KDF.Iterations, storeKeySize)
+	}
+	aead, err := newStoreAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	file.Nonce = make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, file.Nonce); err != nil {
+		return nil, err
+	}
+	file.Ciphertext = aead.Seal(nil, file.Nonce, plaintext, encryptedStoreAdditionalData(file.Version))
+	return json.MarshalIndent(file, "", "\t")
+}
+
+func (c *encryptingCodec) decode(content []byte) ([]byte, error) {
+	var file encryptedFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("not an encrypted credential store")
+	}
+	if file.Version != encryptedStoreVersion {
+		return nil, fmt.Errorf("unsupported encrypted credential store version %d", file.Version)
+	}
+	key := c.key.key
+	if file.KDF != nil {
+		if key != nil {
+			return nil, fmt.Errorf("the store is encrypted with a passphrase, set %s", envStorePassphrase)
+		}
+		if file.KDF.Name != passphraseKDF || file.KDF.Iterations < 1 {
+			return nil, fmt.Errorf("unsupported key derivation %s", file.KDF.Name)
+		}
+		key = pbkdf2SHA256([]byte(c.key.passphrase), file.KDF.Salt, file.KDF.Iterations, storeKeySize)
+	} else if key == nil {
+		return nil, fmt.Errorf("the store is encrypted with a key, set %s or %s", envStoreKey, envStoreKeyFile)
+	}
+	aead, err := newStoreAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+	plaintext, err := aead.Open(nil, file.Nonce, file.Ciphertext, encryptedStoreAdditionalData(file.Version))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt, the key is wrong or the file was tampered with")
+	}
+	return plaintext, nil
+}
+
+func newStoreAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptedStoreAdditionalData binds the ciphertext to the format version
+func encryptedStoreAdditionalData(version int) []byte {
+	return []byte(fmt.Sprintf("docker-credential-acr encrypted store v%d", version))
+}
+
+// pbkdf2SHA256 derives a key from a password as defined in RFC 8018 section 5.2
+// with HMAC-SHA256 as the pseudorandom function
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLength int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLength := prf.Size()
+	blocks := (keyLength + hashLength - 1) / hashLength
+
+	var counter [4]byte
+	derived := make([]byte, 0, blocks*hashLength)
+	u := make([]byte, hashLength)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], uint32(block))
+		prf.Write(counter[:])
+		derived = prf.Sum(derived)
+		t := derived[len(derived)-hashLength:]
+		copy(u, t)
+
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range u {
+				t[j] ^= u[j]
+			}
+		}
+	}
+	return derived[:keyLength]
+}
+
+// newEncryptedFileStore creates a locked file store whose content is encrypted
+// with the key and which refuses to read a file other users may access
+func newEncryptedFileStore(filename string, key *storeKey) *lockedFileStore {
+	return &lockedFileStore{
+		filename: filename,
+		codec:    &encryptingCodec{key: key},
+		private:  true,
+	}
+}
+
+// rekey encrypts the content of an encrypted file store with a new key
+func (s *lockedFileStore) rekey(key *storeKey) error {
+	if _, encrypted := s.codec.(*encryptingCodec); !encrypted {
+		return fmt.Errorf("The credentials in %s are not encrypted", s.filename)
+	}
+	return s.withLock(func() error {
+		config, err := s.load()
+		if err != nil {
+			return err
+		}
+		s.codec = &encryptingCodec{key: key}
+		return s.save(config)
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	dockerCredentials "github.com/docker/cli/cli/config/credentials"
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPbkdf2SHA256(t *testing.T) {
+	testCases := []struct {
+		iterations int
+		expected   string
+	}{
+		{1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+	for _, tc := range testCases {
+		derived := pbkdf2SHA256([]byte("password"), []byte("salt"), tc.iterations, 32)
+		assert.Equal(t, tc.expected, hex.EncodeToString(derived), "iterations %d", tc.iterations)
+	}
+}
+
+func newTestStoreKey(b byte) *storeKey {
+	return &storeKey{key: bytes.Repeat([]byte{b}, storeKeySize)}
+}
+
+func TestEncryptedFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acr-encrypted-store")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, encryptedStoreFile)
+
+	keys := []*storeKey{newTestStoreKey(1), {passphrase: "correct horse battery staple"}}
+	for _, key := range keys {
+		os.Remove(filename)
+		store := newEncryptedFileStore(filename, key)
+		assert.NoError(t, store.Store(dockerTypes.AuthConfig{
+			ServerAddress: "myregistry.azurecr.io",
+			Username:      tokenUsername,
+			IdentityToken: "secret-identity-token",
+		}))
+
+		content, err := ioutil.ReadFile(filename)
+		assert.NoError(t, err)
+		assert.NotContains(t, string(content), "secret-identity-token")
+		assert.NotContains(t, string(content), "myregistry")
+
+		auth, err := newEncryptedFileStore(filename, key).Get("myregistry.azurecr.io")
+		assert.NoError(t, err)
+		assert.Equal(t, "secret-identity-token", auth.IdentityToken)
+
+		_, err = newEncryptedFileStore(filename, newTestStoreKey(2)).GetAll()
+		assert.Error(t, err)
+		_, err = newEncryptedFileStore(filename, &storeKey{passphrase: "wrong"}).GetAll()
+		assert.Error(t, err)
+	}
+}
+
+func TestEncryptedFileStoreDetectsTampering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acr-encrypted-store")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, encryptedStoreFile)
+
+	store := newEncryptedFileStore(filename, newTestStoreKey(1))
+	assert.NoError(t, store.Store(dockerTypes.AuthConfig{ServerAddress: "docker.io", Username: "user", Password: "password"}))
+	content, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+
+	var file encryptedFile
+	assert.NoError(t, json.Unmarshal(content, &file))
+	file.Ciphertext[0] ^= 1
+	tampered, err := json.Marshal(file)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filename, tampered, 0600))
+
+	_, err = store.GetAll()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "tampered")
+}
+
+func TestEncryptedFileStoreRefusesOpenPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not enforced on windows")
+	}
+	dir, err := ioutil.TempDir("", "acr-encrypted-store")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, encryptedStoreFile)
+
+	store := newEncryptedFileStore(filename, newTestStoreKey(1))
+	assert.NoError(t, store.Store(dockerTypes.AuthConfig{ServerAddress: "docker.io", Username: "user", Password: "password"}))
+	assert.NoError(t, os.Chmod(filename, 0644))
+	_, err = store.Get("docker.io")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "too open")
+
+	keyFile := filepath.Join(dir, storeKeyFile)
+	assert.NoError(t, ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(newTestStoreKey(1).key)), 0640))
+	_, err = readStoreKeyFile(keyFile)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "too open")
+}
+
+func TestLoadStoreKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acr-encrypted-store")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{envStoreKey, envStoreKeyFile, envStorePassphrase} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Unsetenv(name)
+	}
+
+	key, err := loadStoreKey(dir)
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+
+	os.Setenv(envStorePassphrase, "passphrase")
+	key, err = loadStoreKey(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, "passphrase", key.passphrase)
+
+	generated, err := generateStoreKeyFile(filepath.Join(dir, storeKeyFile))
+	assert.NoError(t, err)
+	key, err = loadStoreKey(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, generated.key, key.key)
+
+	os.Setenv(envStoreKey, base64.StdEncoding.EncodeToString(newTestStoreKey(3).key))
+	key, err = loadStoreKey(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, newTestStoreKey(3).key, key.key)
+
+	os.Setenv(envStoreKey, "c2hvcnQ=")
+	_, err = loadStoreKey(dir)
+	assert.Error(t, err)
+}
+
+func TestRekey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acr-encrypted-store")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, encryptedStoreFile)
+	oldKey := newTestStoreKey(1)
+
+	var store dockerCredentials.Store = newEncryptedFileStore(filename, oldKey)
+	assert.NoError(t, store.Store(dockerTypes.AuthConfig{ServerAddress: "docker.io", Username: "user", Password: "password"}))
+	wrapper := newTestWrapper(store)
+	wrapper.backend = filename
+
+	var out bytes.Buffer
+	newKeyFile := filepath.Join(dir, "new.key")
+	cmd := newAdminCommand(wrapper, &out)
+	cmd.SetArgs([]string{"rekey", "--new-key-file", newKeyFile})
+	assert.NoError(t, cmd.Execute())
+	assert.Contains(t, out.String(), "Generated a new key")
+
+	_, err = newEncryptedFileStore(filename, oldKey).GetAll()
+	assert.Error(t, err)
+	newKey, err := readStoreKeyFile(newKeyFile)
+	assert.NoError(t, err)
+	auth, err := newEncryptedFileStore(filename, newKey).Get("docker.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "password", auth.Password)
+
+	defer os.Setenv(envStoreNewPassphrase, os.Getenv(envStoreNewPassphrase))
+	os.Setenv(envStoreNewPassphrase, "new passphrase")
+	wrapper = newTestWrapper(newEncryptedFileStore(filename, newKey))
+	cmd = newAdminCommand(wrapper, &out)
+	cmd.SetArgs([]string{"rekey", "--new-passphrase"})
+	assert.NoError(t, cmd.Execute())
+	auth, err = newEncryptedFileStore(filename, &storeKey{passphrase: "new passphrase"}).Get("docker.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "password", auth.Password)
+}
+
+func TestRekeyRequiresEncryptedStore(t *testing.T) {
+	wrapper := newTestWrapper(newMemoryStore())
+	wrapper.backend = "docker-credential-test"
+	cmd := newAdminCommand(wrapper, &bytes.Buffer{})
+	cmd.SetArgs([]string{"rekey", "--new-passphrase"})
+	err := cmd.Execute()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not encrypted")
+}
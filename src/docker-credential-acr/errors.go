@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// nonAcrChallengeError is returned when the registry answered with a valid
+// challenge that cannot be satisfied by an ACR token exchange, such as Basic
+// authentication or a Bearer realm of another token service
+type nonAcrChallengeError struct {
+	challenge string
+}
+
+func (e *nonAcrChallengeError) Error() string {
+	return fmt.Sprintf("Registry is not an ACR registry, authenticate header [%s]", e.challenge)
+}
+
+// isNonAcrChallenge returns true if the error was caused by a registry that
+// is not an ACR registry
+func isNonAcrChallenge(err error) bool {
+	_, ok := err.(*nonAcrChallengeError)
+	return ok
+}
+
+// tokenExpiredError is returned when the stored ACR token has expired and the
+// registry refused to exchange it for a new one
+type tokenExpiredError struct {
+	server string
+	cause  error
+}
+
+func (e *tokenExpiredError) Error() string {
+	return fmt.Sprintf("The ACR token for %s has expired and could not be refreshed (%s). Please run 'az acr login' again",
+		e.server, e.cause)
+}
+
+// isTokenExpired returns true if the error was caused by an expired token
+// that could not be refreshed
+func isTokenExpired(err error) bool {
+	_, ok := err.(*tokenExpiredError)
+	return ok
+}
+
+// registryUnreachableError is returned when the registry or its token service
+// could not be reached to refresh a token
+type registryUnreachableError struct {
+	server string
+	url    string
+	cause  error
+}
+
+func (e *registryUnreachableError) Error() string {
+	return fmt.Sprintf("Unable to reach %s to refresh the ACR token for %s (%s). Please check your network and proxy settings",
+		e.url, e.server, e.cause)
+}
+
+// isRegistryUnreachable returns true if the error was caused by a registry
+// that could not be reached
+func isRegistryUnreachable(err error) bool {
+	_, ok := err.(*registryUnreachableError)
+	return ok
+}
+
+// noTerminalError is returned when device code login has no terminal to show
+// its instructions on, such as when docker runs in a CI job
+type noTerminalError struct {
+	device string
+	cause  error
+}
+
+func (e *noTerminalError) Error() string {
+	return fmt.Sprintf("Device code login needs a terminal to show its instructions, unable to open %s (%s). Please run 'az acr login' or configure a service principal or managed identity",
+		e.device, e.cause)
+}
+
+// isNoTerminal returns true if the error was caused by a missing terminal
+func isNoTerminal(err error) bool {
+	_, ok := err.(*noTerminalError)
+	return ok
+}
+
+// registryUnavailableError is returned when the registry or its token service
+// answered with an unexpected status, such as a server error that persisted
+// through the retries
+type registryUnavailableError struct {
+	server string
+	url    string
+	status int
+}
+
+func (e *registryUnavailableError) Error() string {
+	return fmt.Sprintf("The registry %s is unavailable, %s responded with status %d %s. Please try again later",
+		e.server, e.url, e.status, http.StatusText(e.status))
+}
+
+// isRegistryUnavailable returns true if the error was caused by a registry
+// that responded with an unexpected status
+func isRegistryUnavailable(err error) bool {
+	_, ok := err.(*registryUnavailableError)
+	return ok
+}
+
+// tenantMismatchError is returned when the registry issued a token for a
+// different AAD tenant than the one the login was made with
+type tenantMismatchError struct {
+	server   string
+	expected string
+	actual   string
+}
+
+func (e *tenantMismatchError) Error() string {
+	return fmt.Sprintf("The ACR token for %s was issued for tenant %s instead of tenant %s. Please run 'az acr login' again with an account of the registry's tenant",
+		e.server, e.actual, e.expected)
+}
+
+// isTenantMismatch returns true if the error was caused by a token issued for
+// another tenant
+func isTenantMismatch(err error) bool {
+	_, ok := err.(*tenantMismatchError)
+	return ok
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	cliconfig "github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	dockerCredentials "github.com/docker/cli/cli/config/credentials"
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/ioutils"
+)
+
+// lockedFileStore keeps credentials in a docker config file, like the file
+// store of docker, but is safe to use from many processes at once. Every
+// operation holds an advisory lock on a sibling .lock file and reloads the
+// config file, so concurrent helpers do not lose each other's updates.
+// Changes are written to a temporary file which is synced and renamed over
+// the config file, so readers never see a partially written file.
+type lockedFileStore struct {
+	filename string
+	// codec transforms the content on disk, the content is plain JSON without it
+	codec fileCodec
+	// private stores refuse to read a file that other users may access
+	private bool
+}
+
+// fileCodec transforms the content of a locked file store on its way to and
+// from disk
+type fileCodec interface {
+	encode(plaintext []byte) ([]byte, error)
+	decode(content []byte) ([]byte, error)
+}
+
+func newLockedFileStore(filename string) *lockedFileStore {
+	return &lockedFileStore{filename: filename}
+}
+
+func (s *lockedFileStore) Erase(serverAddress string) error {
+	return s.update(func(config *configfile.ConfigFile) bool {
+		if _, found := config.AuthConfigs[serverAddress]; !found {
+			return false
+		}
+		delete(config.AuthConfigs, serverAddress)
+		return true
+	})
+}
+
+func (s *lockedFileStore) Get(serverAddress string) (authConfig dockerTypes.AuthConfig, err error) {
+	err = s.view(func(config *configfile.ConfigFile) error {
+		authConfig, err = dockerCredentials.NewFileStore(config).Get(serverAddress)
+		return err
+	})
+	return authConfig, err
+}
+
+func (s *lockedFileStore) GetAll() (authConfigs map[string]dockerTypes.AuthConfig, err error) {
+	err = s.view(func(config *configfile.ConfigFile) error {
+		authConfigs = config.AuthConfigs
+		return nil
+	})
+	return authConfigs, err
+}
+
+func (s *lockedFileStore) Store(authConfig dockerTypes.AuthConfig) error {
+	return s.update(func(config *configfile.ConfigFile) bool {
+		config.AuthConfigs[authConfig.ServerAddress] = authConfig
+		return true
+	})
+}
+
+// view reads the config file under the lock
+func (s *lockedFileStore) view(read func(*configfile.ConfigFile) error) error {
+	return s.withLock(func() error {
+		config, err := s.load()
+		if err != nil {
+			return err
+		}
+		return read(config)
+	})
+}
+
+// update reads the config file, applies mutate and writes the file back if
+// mutate reports a change, all under the lock
+func (s *lockedFileStore) update(mutate func(*configfile.ConfigFile) bool) error {
+	return s.withLock(func() error {
+		config, err := s.load()
+		if err != nil {
+			return err
+		}
+		if !mutate(config) {
+			return nil
+		}
+		return s.save(config)
+	})
+}
+
+func (s *lockedFileStore) withLock(action func() error) error {
+	lock, err := os.OpenFile(s.filename+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to open lock file for %s, error: %s", s.filename, err)
+	}
+	defer lock.Close()
+	if err = lockFile(lock); err != nil {
+		return fmt.Errorf("Failed to lock %s, error: %s", s.filename, err)
+	}
+	defer unlockFile(lock)
+	return action()
+}
+
+// load reads the config file, a missing or empty file holds no credentials
+func (s *lockedFileStore) load() (*configfile.ConfigFile, error) {
+	if s.private {
+		if err := checkPrivatePermissions(s.filename); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	content, err := ioutil.ReadFile(s.filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Failed to read %s, error: %s", s.filename, err)
+	}
+	if len(bytes.TrimSpace(content)) != 0 && s.codec != nil {
+		if content, err = s.codec.decode(content); err != nil {
+			return nil, fmt.Errorf("Failed to read %s, error: %s", s.filename, err)
+		}
+	}
+	if len(bytes.TrimSpace(content)) == 0 {
+		return &configfile.ConfigFile{
+			Filename:    s.filename,
+			AuthConfigs: map[string]dockerTypes.AuthConfig{},
+		}, nil
+	}
+	config, err := cliconfig.LoadFromReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load %s, error: %s", s.filename, err)
+	}
+	if config.AuthConfigs == nil {
+		config.AuthConfigs = map[string]dockerTypes.AuthConfig{}
+	}
+	config.Filename = s.filename
+	return config, nil
+}
+
+// save atomically replaces the config file
+func (s *lockedFileStore) save(config *configfile.ConfigFile) error {
+	var content bytes.Buffer
+	if err := config.SaveToWriter(&content); err != nil {
+		return fmt.Errorf("Failed to encode %s, error: %s", s.filename, err)
+	}
+	encoded := content.Bytes()
+	if s.codec != nil {
+		var err error
+		if encoded, err = s.codec.encode(encoded); err != nil {
+			return fmt.Errorf("Failed to encode %s, error: %s", s.filename, err)
+		}
+	}
+	if err := ioutils.AtomicWriteFile(s.filename, encoded, 0600); err != nil {
+		return fmt.Errorf("Failed to write %s, error: %s", s.filename, err)
+	}
+	return nil
+}
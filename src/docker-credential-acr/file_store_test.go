@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	dockerCredentials "github.com/docker/cli/cli/config/credentials"
+	dockerTypes "github.com/docker/docker/api/types"
+	helperCredentials "github.com/docker/docker-credential-helpers/credentials"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	envStoreHelperFile   = "TEST_LOCKED_FILE_STORE_FILE"
+	envStoreHelperWorker = "TEST_LOCKED_FILE_STORE_WORKER"
+	storeStressWorkers   = 16
+	storeStressServers   = 10
+)
+
+// stressLockedFileStore adds storeStressServers credentials for the worker
+// through a store of its own and erases every other one again
+func stressLockedFileStore(filename string, worker int) error {
+	var store dockerCredentials.Store = newLockedFileStore(filename)
+	wrapper := newTestWrapper(store)
+	for i := 0; i < storeStressServers; i++ {
+		err := wrapper.Add(&helperCredentials.Credentials{
+			ServerURL: stressServer(worker, i),
+			Username:  tokenUsername,
+			Secret:    fmt.Sprintf("token-%d-%d", worker, i),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for i := 0; i < storeStressServers; i += 2 {
+		if err := wrapper.Delete(stressServer(worker, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stressServer(worker int, i int) string {
+	return fmt.Sprintf("registry%d-%d.azurecr.io", worker, i)
+}
+
+func assertStressResult(t *testing.T, filename string) {
+	content, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	var parsed map[string]interface{}
+	assert.NoError(t, json.Unmarshal(content, &parsed))
+
+	auths, err := newLockedFileStore(filename).GetAll()
+	assert.NoError(t, err)
+	assert.Len(t, auths, storeStressWorkers*storeStressServers/2)
+	for worker := 0; worker < storeStressWorkers; worker++ {
+		for i := 0; i < storeStressServers; i++ {
+			auth, found := auths[stressServer(worker, i)]
+			if i%2 == 0 {
+				assert.False(t, found, stressServer(worker, i))
+			} else if assert.True(t, found, stressServer(worker, i)) {
+				assert.Equal(t, fmt.Sprintf("token-%d-%d", worker, i), auth.IdentityToken)
+			}
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(filepath.Dir(filename), "*"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 2, "only the config and lock files are left: %v", files)
+}
+
+func TestLockedFileStoreConcurrentUpdates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acr-file-store")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.json")
+
+	var wait sync.WaitGroup
+	errs := make(chan error, storeStressWorkers)
+	for worker := 0; worker < storeStressWorkers; worker++ {
+		wait.Add(1)
+		go func(worker int) {
+			defer wait.Done()
+			errs <- stressLockedFileStore(filename, worker)
+		}(worker)
+	}
+	wait.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	assertStressResult(t, filename)
+}
+
+func TestLockedFileStoreConcurrentProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acr-file-store")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.json")
+
+	var commands []*exec.Cmd
+	for worker := 0; worker < storeStressWorkers; worker++ {
+		cmd := exec.Command(os.Args[0], "-test.run=TestLockedFileStoreHelperProcess")
+		cmd.Env = append(os.Environ(), envStoreHelperFile+"="+filename, envStoreHelperWorker+"="+strconv.Itoa(worker))
+		assert.NoError(t, cmd.Start())
+		commands = append(commands, cmd)
+	}
+	for _, cmd := range commands {
+		assert.NoError(t, cmd.Wait())
+	}
+	assertStressResult(t, filename)
+}
+
+// TestLockedFileStoreHelperProcess is run as a separate process by
+// TestLockedFileStoreConcurrentProcesses
+func TestLockedFileStoreHelperProcess(t *testing.T) {
+	filename := os.Getenv(envStoreHelperFile)
+	if filename == "" {
+		return
+	}
+	worker, err := strconv.Atoi(os.Getenv(envStoreHelperWorker))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = stressLockedFileStore(filename, worker); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockedFileStoreLoadsEmptyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acr-file-store")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.json")
+	assert.NoError(t, ioutil.WriteFile(filename, nil, 0600))
+
+	store := newLockedFileStore(filename)
+	auths, err := store.GetAll()
+	assert.NoError(t, err)
+	assert.Empty(t, auths)
+
+	assert.NoError(t, store.Store(dockerTypes.AuthConfig{ServerAddress: "docker.io", Username: "user", Password: "password"}))
+	auth, err := store.Get("docker.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "password", auth.Password)
+
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("{"), 0600))
+	_, err = store.GetAll()
+	assert.Error(t, err)
+}
@@ -3,4 +3,3 @@
 package main
 
 const helperSuffix = "osxkeychain"
-const exeFinder = "which"
@@ -3,4 +3,3 @@
 package main
 
 const helperSuffix = "secretservice"
-const exeFinder = "which"
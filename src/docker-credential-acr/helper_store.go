@@ -0,0 +1,74 @@
+package main
+
+import (
+	helperClient "github.com/docker/docker-credential-helpers/client"
+	helperCredentials "github.com/docker/docker-credential-helpers/credentials"
+	dockerTypes "github.com/docker/docker/api/types"
+)
+
+// helperStore keeps credentials in a docker credential helper only. The native
+// store of the docker cli also saves the docker config file on every Store and
+// Erase, which rewrites it with only the fields the vendored configfile knows.
+// Docker keeps its own config file up to date, so the helper must never touch it.
+type helperStore struct {
+	programFunc helperClient.ProgramFunc
+}
+
+func newHelperStore(backend string) *helperStore {
+	return &helperStore{programFunc: helperClient.NewShellProgramFunc("docker-credential-" + backend)}
+}
+
+func (s *helperStore) Erase(serverAddress string) error {
+	return helperClient.Erase(s.programFunc, serverAddress)
+}
+
+// Get returns empty credentials when the helper has none for the server
+func (s *helperStore) Get(serverAddress string) (dockerTypes.AuthConfig, error) {
+	var auth dockerTypes.AuthConfig
+	creds, err := helperClient.Get(s.programFunc, serverAddress)
+	if err != nil {
+		if helperCredentials.IsErrCredentialsNotFound(err) {
+			return auth, nil
+		}
+		return auth, err
+	}
+	if creds.Username == tokenUsername {
+		auth.IdentityToken = creds.Secret
+	} else {
+		auth.Username = creds.Username
+		auth.Password = creds.Secret
+	}
+	auth.ServerAddress = serverAddress
+	return auth, nil
+}
+
+// GetAll leaves out the chunk entries of chunkedStore, which are not registries
+func (s *helperStore) GetAll() (map[string]dockerTypes.AuthConfig, error) {
+	servers, err := helperClient.List(s.programFunc)
+	if err != nil {
+		return nil, err
+	}
+	auths := make(map[string]dockerTypes.AuthConfig)
+	for server := range servers {
+		if isChunkKey(server) {
+			continue
+		}
+		if auths[server], err = s.Get(server); err != nil {
+			return nil, err
+		}
+	}
+	return auths, nil
+}
+
+func (s *helperStore) Store(authConfig dockerTypes.AuthConfig) error {
+	creds := &helperCredentials.Credentials{
+		ServerURL: authConfig.ServerAddress,
+		Username:  authConfig.Username,
+		Secret:    authConfig.Password,
+	}
+	if authConfig.IdentityToken != "" {
+		creds.Username = tokenUsername
+		creds.Secret = authConfig.IdentityToken
+	}
+	return helperClient.Store(s.programFunc, creds)
+}
@@ -3,4 +3,3 @@
 package main
 
 const helperSuffix = ""
-const exeFinder = "where.exe"
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// httpConfig controls the http client used to reach registries and AAD
+type httpConfig struct {
+	// Timeout of a single request, as a duration such as "30s"
+	Timeout string `json:"timeout,omitempty"`
+	// Proxy is the URL of the proxy to use. Without it HTTPS_PROXY, HTTP_PROXY
+	// and NO_PROXY from the environment are honored.
+	Proxy string `json:"proxy,omitempty"`
+	// NoProxy lists hosts, domain suffixes and CIDRs to reach without Proxy
+	NoProxy []string `json:"noProxy,omitempty"`
+	// CAFile is a PEM bundle of root CAs trusted in addition to the system ones
+	CAFile string `json:"caFile,omitempty"`
+	// ClientCertFile and ClientKeyFile are a PEM client certificate and key
+	// presented to servers that request one
+	ClientCertFile string `json:"clientCertFile,omitempty"`
+	ClientKeyFile  string `json:"clientKeyFile,omitempty"`
+}
+
+const (
+	envHTTPTimeout    = "DOCKER_CREDENTIAL_ACR_TIMEOUT"
+	envHTTPCAFile     = "DOCKER_CREDENTIAL_ACR_CA_FILE"
+	envHTTPClientCert = "DOCKER_CREDENTIAL_ACR_CLIENT_CERT"
+	envHTTPClientKey  = "DOCKER_CREDENTIAL_ACR_CLIENT_KEY"
+
+	defaultHTTPTimeout = 30 * time.Second
+)
+
+// applyEnvironment overrides the settings with the ones from the environment
+func (c *httpConfig) applyEnvironment() {
+	if timeout := os.Getenv(envHTTPTimeout); timeout != "" {
+		c.Timeout = timeout
+	}
+	if caFile := os.Getenv(envHTTPCAFile); caFile != "" {
+		c.CAFile = caFile
+	}
+	if clientCert := os.Getenv(envHTTPClientCert); clientCert != "" {
+		c.ClientCertFile = clientCert
+	}
+	if clientKey := os.Getenv(envHTTPClientKey); clientKey != "" {
+		c.ClientKeyFile = clientKey
+	}
+}
+
+// newHTTPClient creates the http client described by the config
+func newHTTPClient(config httpConfig) (*http.Client, error) {
+	timeout := defaultHTTPTimeout
+	if config.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(config.Timeout); err != nil || timeout < 0 {
+			return nil, fmt.Errorf("Invalid http timeout %s", config.Timeout)
+		}
+	}
+
+	tlsConfig := &tls.Config{}
+	if config.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		content, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA bundle %s, error: %s", config.CAFile, err)
+		}
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.ClientCertFile != "" || config.ClientKeyFile != "" {
+		keyFile := config.ClientKeyFile
+		if keyFile == "" {
+			keyFile = config.ClientCertFile
+		}
+		certificate, err := tls.LoadX509KeyPair(config.ClientCertFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate %s, error: %s", config.ClientCertFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if config.Proxy != "" {
+		proxyURL, err := url.Parse(config.Proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("Invalid proxy %s", config.Proxy)
+		}
+		proxy = fixedProxy(proxyURL, config.NoProxy)
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy: proxy,
+			DialContext: (&net.Dialer{
+				Timeout:   timeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: timeout,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}, nil
+}
+
+// fixedProxy sends every request through proxyURL unless its host matches an
+// entry of noProxy: an exact host, a domain suffix such as .example.com, a
+// CIDR or "*"
+func fixedProxy(proxyURL *url.URL, noProxy []string) func(*http.Request) (*url.URL, error) {
+	return func(r *http.Request) (*url.URL, error) {
+		host := r.URL.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		host = strings.ToLower(host)
+		ip := net.ParseIP(host)
+		for _, entry := range noProxy {
+			entry = strings.ToLower(strings.TrimSpace(entry))
+			switch {
+			case entry == "":
+			case entry == "*", entry == host:
+				return nil, nil
+			case strings.HasPrefix(entry, ".") && strings.HasSuffix(host, entry):
+				return nil, nil
+			case ip != nil && strings.Contains(entry, "/"):
+				if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(ip) {
+					return nil, nil
+				}
+			}
+		}
+		return proxyURL, nil
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPClientTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	httpClient, err := newHTTPClient(httpConfig{Timeout: "50ms"})
+	assert.NoError(t, err)
+	_, err = httpClient.Get(server.URL)
+	assert.Error(t, err)
+
+	_, err = newHTTPClient(httpConfig{Timeout: "soon"})
+	assert.Error(t, err)
+}
+
+func TestHTTPClientCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "acr-http")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	httpClient, err := newHTTPClient(httpConfig{})
+	assert.NoError(t, err)
+	_, err = httpClient.Get(server.URL)
+	assert.Error(t, err, "test server certificate should not be trusted by default")
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caContent := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.TLS.Certificates[0].Certificate[0]})
+	assert.NoError(t, ioutil.WriteFile(caFile, caContent, 0600))
+	httpClient, err = newHTTPClient(httpConfig{CAFile: caFile})
+	assert.NoError(t, err)
+	resp, err := httpClient.Get(server.URL)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+	}
+
+	_, err = newHTTPClient(httpConfig{CAFile: filepath.Join(dir, "missing.pem")})
+	assert.Error(t, err)
+}
+
+func TestHTTPClientCertificate(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "acr-http")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "client.pem")
+	assert.NoError(t, writeTestCertificate(certFile))
+	caFile := filepath.Join(dir, "ca.pem")
+	caContent := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.TLS.Certificates[0].Certificate[0]})
+	assert.NoError(t, ioutil.WriteFile(caFile, caContent, 0600))
+
+	httpClient, err := newHTTPClient(httpConfig{CAFile: caFile, ClientCertFile: certFile})
+	assert.NoError(t, err)
+	resp, err := httpClient.Get(server.URL)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	}
+}
+
+func TestHTTPClientProxy(t *testing.T) {
+	httpClient, err := newHTTPClient(httpConfig{
+		Proxy:   "http://proxy.example.com:3128",
+		NoProxy: []string{"internal.example.com", ".corp.example.com", "10.0.0.0/8"},
+	})
+	assert.NoError(t, err)
+	proxy := httpClient.Transport.(*http.Transport).Proxy
+
+	testCases := []struct {
+		target  string
+		proxied bool
+	}{
+		{target: "https://myregistry.azurecr.io/v2/", proxied: true},
+		{target: "https://internal.example.com/v2/", proxied: false},
+		{target: "https://registry.corp.example.com:5000/v2/", proxied: false},
+		{target: "https://10.1.2.3/v2/", proxied: false},
+		{target: "https://192.168.1.1/v2/", proxied: true},
+	}
+	for _, tc := range testCases {
+		target, _ := url.Parse(tc.target)
+		proxyURL, err := proxy(&http.Request{URL: target})
+		assert.NoError(t, err, tc.target)
+		if tc.proxied {
+			if assert.NotNil(t, proxyURL, tc.target) {
+				assert.Equal(t, "proxy.example.com:3128", proxyURL.Host, tc.target)
+			}
+		} else {
+			assert.Nil(t, proxyURL, tc.target)
+		}
+	}
+
+	_, err = newHTTPClient(httpConfig{Proxy: "not a proxy"})
+	assert.Error(t, err)
+}
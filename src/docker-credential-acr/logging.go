@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	envLogLevel = "DOCKER_CREDENTIAL_ACR_LOG"
+	envLogFile  = "DOCKER_CREDENTIAL_ACR_LOG_FILE"
+)
+
+// form fields and headers that carry secrets and must never be logged
+var secretFormFields = []string{"refresh_token", "access_token", "client_secret", "client_assertion", "password"}
+
+// setupLogging configures the standard logger from DOCKER_CREDENTIAL_ACR_LOG,
+// one of debug, info, warn or error, and DOCKER_CREDENTIAL_ACR_LOG_FILE, a
+// file the log is appended to instead of stderr. The returned closer releases
+// the log file, if any.
+func setupLogging() (io.Closer, error) {
+	if levelName := os.Getenv(envLogLevel); levelName != "" {
+		level, err := logrus.ParseLevel(levelName)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", envLogLevel, levelName)
+		}
+		logrus.SetLevel(level)
+	}
+	logFile := os.Getenv(envLogFile)
+	if logFile == "" {
+		return nopCloser{}, nil
+	}
+	file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open log file %s, error: %s", logFile, err)
+	}
+	logrus.SetOutput(file)
+	logrus.SetFormatter(&logrus.TextFormatter{DisableColors: true, FullTimestamp: true})
+	return file, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// redactToken describes a token without revealing it
+func redactToken(token string) string {
+	if token == "" {
+		return "<empty>"
+	}
+	return fmt.Sprintf("<redacted %d chars>", len(token))
+}
+
+// redactForm returns a copy of the form with all secret values redacted
+func redactForm(form url.Values) url.Values {
+	redacted := url.Values{}
+	for key, values := range form {
+		redacted[key] = values
+	}
+	for _, key := range secretFormFields {
+		if value := form.Get(key); value != "" {
+			redacted.Set(key, redactToken(value))
+		}
+	}
+	return redacted
+}
+
+// tokenExpiryFields describes the expiry of an ACR token for the log
+func tokenExpiryFields(token *acrTokenPayload) logrus.Fields {
+	return logrus.Fields{
+		"expiry":         time.Unix(token.Expiration, 0).UTC().Format(time.RFC3339),
+		"tenant":         token.TenantID,
+		"expiredOrNear":  token.isExpiredOrNear(),
+		"timeShiftGrace": fmt.Sprintf("%ds", timeShiftBuffer),
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactForm(t *testing.T) {
+	form := url.Values{
+		"grant_type":    []string{"refresh_token"},
+		"refresh_token": []string{"secret-token"},
+		"service":       []string{"myregistry.azurecr.io"},
+	}
+	redacted := redactForm(form)
+	assert.Equal(t, "<redacted 12 chars>", redacted.Get("refresh_token"))
+	assert.Equal(t, "myregistry.azurecr.io", redacted.Get("service"))
+	assert.Equal(t, "secret-token", form.Get("refresh_token"))
+}
+
+func TestDebugLogTracesRoundTripWithoutSecrets(t *testing.T) {
+	defer useInsecureClient()()
+	var output bytes.Buffer
+	defer func(level logrus.Level) {
+		logrus.SetLevel(level)
+		logrus.SetOutput(os.Stderr)
+	}(logrus.GetLevel())
+	logrus.SetLevel(logrus.DebugLevel)
+	logrus.SetOutput(&output)
+
+	refreshed := makeAcrToken(time.Now().Add(3*time.Hour), "tenant", "new")
+	registry := newFakeRegistry(refreshed)
+	defer registry.Close()
+	expired := makeAcrToken(time.Now().Add(-time.Hour), "tenant", "old")
+	store := newMemoryStore()
+	store.Store(dockerTypes.AuthConfig{
+		ServerAddress: registry.host(),
+		Username:      tokenUsername,
+		IdentityToken: expired,
+	})
+
+	_, _, err := newTestWrapper(store).Get(registry.host())
+	assert.NoError(t, err)
+
+	log := output.String()
+	for _, message := range []string{
+		"Stored identity token",
+		"Requesting challenge",
+		"Received challenge response",
+		"Requesting token exchange",
+		"Received token exchange response",
+		"Cached refreshed token",
+	} {
+		assert.Contains(t, log, message)
+	}
+	assert.Contains(t, log, "status=401")
+	assert.Contains(t, log, "status=200")
+	assert.False(t, strings.Contains(log, expired), "log contains the stored token")
+	assert.False(t, strings.Contains(log, refreshed), "log contains the refreshed token")
+}
+
+func TestSetupLogging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acr-log")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(level logrus.Level) {
+		logrus.SetLevel(level)
+		logrus.SetOutput(os.Stderr)
+	}(logrus.GetLevel())
+	defer os.Setenv(envLogLevel, os.Getenv(envLogLevel))
+	defer os.Setenv(envLogFile, os.Getenv(envLogFile))
+
+	os.Setenv(envLogLevel, "verbose")
+	_, err = setupLogging()
+	assert.Error(t, err)
+
+	logPath := filepath.Join(dir, "helper.log")
+	os.Setenv(envLogLevel, "debug")
+	os.Setenv(envLogFile, logPath)
+	closer, err := setupLogging()
+	assert.NoError(t, err)
+	logrus.Debug("hello from the helper")
+	closer.Close()
+
+	content, err := ioutil.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "hello from the helper")
+}
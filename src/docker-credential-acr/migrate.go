@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/docker/cli/cli/config/configfile"
+	dockerCredentials "github.com/docker/cli/cli/config/credentials"
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/spf13/cobra"
+)
+
+// dockerConfigBackend names the auths of the docker config file as a backend
+// to migrate from, which is where docker keeps credentials without a helper
+const dockerConfigBackend = "docker-config"
+
+// conflict resolutions for servers with credentials in both backends
+const (
+	keepNewer       = "keep-newer"
+	keepSource      = "keep-source"
+	keepDestination = "keep-destination"
+)
+
+// migration actions reported per server
+const (
+	migrationCopied    = "copied"
+	migrationReplaced  = "replaced"
+	migrationKept      = "kept"
+	migrationUnchanged = "unchanged"
+)
+
+type migrationOptions struct {
+	conflict string
+	dryRun   bool
+	purge    bool
+}
+
+// migrationResult is the outcome of migrating the credentials of one server
+type migrationResult struct {
+	server string
+	action string
+	reason string
+	purged bool
+}
+
+func newMigrateCommand(wrapper *storeWrapper, out io.Writer) *cobra.Command {
+	var from, to string
+	options := migrationOptions{}
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Move credentials from one credential store to another.",
+		Long: "Copy the credentials of one credential store to another. A store is either " + dockerConfigBackend +
+			" for the auths of the docker config file, encrypted-file, file or the name of a docker credential helper.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if from == "" || to == "" {
+				return fmt.Errorf("Please specify the stores to migrate --from and --to")
+			}
+			if from == to {
+				return fmt.Errorf("Unable to migrate %s to itself", from)
+			}
+			switch options.conflict {
+			case keepNewer, keepSource, keepDestination:
+			default:
+				return fmt.Errorf("Invalid conflict resolution %s, expected one of %s, %s or %s", options.conflict, keepNewer, keepSource, keepDestination)
+			}
+
+			source, err := openMigrationBackend(wrapper.dockerConfig, from)
+			if err != nil {
+				return fmt.Errorf("Unable to open %s, error: %s", from, err)
+			}
+			destination, err := openMigrationBackend(wrapper.dockerConfig, to)
+			if err != nil {
+				return fmt.Errorf("Unable to open %s, error: %s", to, err)
+			}
+			results, err := migrateCredentials(source, destination, options)
+			if err != nil {
+				return err
+			}
+			return writeMigrationReport(out, results, options)
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&from, "from", "", "Store to migrate the credentials from.")
+	flags.StringVar(&to, "to", "", "Store to migrate the credentials to.")
+	flags.StringVar(&options.conflict, "conflict", keepNewer,
+		"Resolution of servers with credentials in both stores: "+keepNewer+" by token expiry, "+keepSource+" or "+keepDestination+".")
+	flags.BoolVar(&options.dryRun, "dry-run", false, "Report what would be migrated without changing anything.")
+	flags.BoolVar(&options.purge, "purge", false, "Erase the migrated credentials from the source store, except those kept out of the destination.")
+	return cmd
+}
+
+// openMigrationBackend opens a backend by name, like the backends of the store
+// chain, or the auths of the docker config file
+func openMigrationBackend(config *configfile.ConfigFile, backend string) (dockerCredentials.Store, error) {
+	if backend == dockerConfigBackend {
+		return newDockerConfigStore(config), nil
+	}
+	prober, err := newHelperProber(config, settings.Store, true)
+	if err != nil {
+		return nil, err
+	}
+	store, _, err := openStoreBackend(config, backend, settings.Store, prober)
+	if err != nil {
+		return nil, err
+	}
+	return *store, nil
+}
+
+// migrateCredentials copies the credentials of every server of the source to
+// the destination, resolving conflicts as the options say. The results are
+// sorted by server.
+func migrateCredentials(source dockerCredentials.Store, destination dockerCredentials.Store, options migrationOptions) ([]migrationResult, error) {
+	sourceAuths, err := source.GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("Error listing the credentials to migrate, error: %s", err)
+	}
+	destinationAuths, err := destination.GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("Error listing the credentials of the destination, error: %s", err)
+	}
+
+	var servers []string
+	for server := range sourceAuths {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	results := make([]migrationResult, 0, len(servers))
+	for _, server := range servers {
+		auth := sourceAuths[server]
+		auth.ServerAddress = server
+		if secretOf(auth) == "" && auth.Username == "" {
+			continue
+		}
+		result := resolveMigration(server, auth, destinationAuths, options.conflict)
+		// credentials that were kept out of the destination would be lost
+		if options.purge {
+			if result.action == migrationKept {
+				result.reason += ", the source was not purged"
+			} else {
+				result.purged = true
+			}
+		}
+		if !options.dryRun {
+			if result.action == migrationCopied || result.action == migrationReplaced {
+				if err = destination.Store(auth); err != nil {
+					return results, fmt.Errorf("Error migrating the credentials for %s, error: %s", server, err)
+				}
+			}
+			if result.purged {
+				if err = source.Erase(server); err != nil {
+					return results, fmt.Errorf("Error purging the credentials for %s, error: %s", server, err)
+				}
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// resolveMigration decides what to do with the credentials of a server
+func resolveMigration(server string, auth dockerTypes.AuthConfig, destinationAuths map[string]dockerTypes.AuthConfig, conflict string) migrationResult {
+	result := migrationResult{server: server}
+	existing, found := destinationAuths[server]
+	switch {
+	case !found || (secretOf(existing) == "" && existing.Username == ""):
+		result.action = migrationCopied
+	case secretOf(existing) == secretOf(auth) && existing.Username == auth.Username:
+		result.action = migrationUnchanged
+	case conflict == keepSource:
+		result.action = migrationReplaced
+		result.reason = "the destination had other credentials"
+	case conflict == keepDestination:
+		result.action = migrationKept
+		result.reason = "the destination has other credentials"
+	default:
+		sourceExpiry, sourceOk := tokenExpiration(auth)
+		destinationExpiry, destinationOk := tokenExpiration(existing)
+		if sourceOk && (!destinationOk || sourceExpiry > destinationExpiry) {
+			result.action = migrationReplaced
+			result.reason = "the source token expires later"
+		} else {
+			result.action = migrationKept
+			if destinationOk {
+				result.reason = "the destination token expires later"
+			} else {
+				result.reason = "the expiry of the credentials cannot be compared"
+			}
+		}
+	}
+	return result
+}
+
+// tokenExpiration returns the expiry of an ACR identity token
+func tokenExpiration(auth dockerTypes.AuthConfig) (int64, bool) {
+	if auth.IdentityToken == "" {
+		return 0, false
+	}
+	token, err := parseAcrToken(auth.IdentityToken)
+	if err != nil {
+		return 0, false
+	}
+	return token.Expiration, true
+}
+
+func writeMigrationReport(out io.Writer, results []migrationResult, options migrationOptions) error {
+	table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "SERVER\tACTION\tPURGED\tDETAILS")
+	for _, result := range results {
+		purged := "-"
+		if result.purged {
+			purged = "yes"
+		}
+		reason := result.reason
+		if reason == "" {
+			reason = "-"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", result.server, result.action, purged, reason)
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	if options.dryRun {
+		_, err := fmt.Fprintln(out, "Dry run, no credentials were changed")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func newMigrationStores() (*memoryStore, *memoryStore) {
+	older := makeAcrToken(time.Now().Add(time.Hour), "tenant", "older")
+	newer := makeAcrToken(time.Now().Add(2*time.Hour), "tenant", "newer")
+	source := newMemoryStore()
+	destination := newMemoryStore()
+	for _, auth := range []dockerTypes.AuthConfig{
+		{ServerAddress: "copied.azurecr.io", IdentityToken: older},
+		{ServerAddress: "newer.azurecr.io", IdentityToken: newer},
+		{ServerAddress: "older.azurecr.io", IdentityToken: older},
+		{ServerAddress: "same.azurecr.io", IdentityToken: older},
+		{ServerAddress: "docker.io", Username: "user", Password: "source"},
+	} {
+		source.Store(auth)
+	}
+	for _, auth := range []dockerTypes.AuthConfig{
+		{ServerAddress: "newer.azurecr.io", IdentityToken: older},
+		{ServerAddress: "older.azurecr.io", IdentityToken: newer},
+		{ServerAddress: "same.azurecr.io", IdentityToken: older},
+		{ServerAddress: "docker.io", Username: "user", Password: "destination"},
+	} {
+		destination.Store(auth)
+	}
+	return source, destination
+}
+
+func migrationActions(results []migrationResult) map[string]string {
+	actions := make(map[string]string)
+	for _, result := range results {
+		actions[result.server] = result.action
+	}
+	return actions
+}
+
+func TestMigrateCredentials(t *testing.T) {
+	testCases := []struct {
+		conflict string
+		expected map[string]string
+	}{
+		{keepNewer, map[string]string{
+			"copied.azurecr.io": migrationCopied,
+			"newer.azurecr.io":  migrationReplaced,
+			"older.azurecr.io":  migrationKept,
+			"same.azurecr.io":   migrationUnchanged,
+			"docker.io":         migrationKept,
+		}},
+		{keepSource, map[string]string{
+			"copied.azurecr.io": migrationCopied,
+			"newer.azurecr.io":  migrationReplaced,
+			"older.azurecr.io":  migrationReplaced,
+			"same.azurecr.io":   migrationUnchanged,
+			"docker.io":         migrationReplaced,
+		}},
+		{keepDestination, map[string]string{
+			"copied.azurecr.io": migrationCopied,
+			"newer.azurecr.io":  migrationKept,
+			"older.azurecr.io":  migrationKept,
+			"same.azurecr.io":   migrationUnchanged,
+			"docker.io":         migrationKept,
+		}},
+	}
+	for _, tc := range testCases {
+		source, destination := newMigrationStores()
+		results, err := migrateCredentials(source, destination, migrationOptions{conflict: tc.conflict})
+		assert.NoError(t, err, tc.conflict)
+		assert.Equal(t, tc.expected, migrationActions(results), tc.conflict)
+		assert.Equal(t, "copied.azurecr.io", results[0].server)
+
+		sourceAuths, _ := source.GetAll()
+		destinationAuths, _ := destination.GetAll()
+		assert.Len(t, sourceAuths, 5, tc.conflict)
+		for server, action := range tc.expected {
+			switch action {
+			case migrationCopied, migrationReplaced, migrationUnchanged:
+				assert.Equal(t, secretOf(sourceAuths[server]), secretOf(destinationAuths[server]), "%s %s", tc.conflict, server)
+			case migrationKept:
+				assert.NotEqual(t, secretOf(sourceAuths[server]), secretOf(destinationAuths[server]), "%s %s", tc.conflict, server)
+			}
+		}
+	}
+}
+
+func TestMigrateCredentialsDryRun(t *testing.T) {
+	source, destination := newMigrationStores()
+	before, _ := destination.GetAll()
+	results, err := migrateCredentials(source, destination, migrationOptions{conflict: keepSource, dryRun: true, purge: true})
+	assert.NoError(t, err)
+	assert.Len(t, results, 5)
+
+	after, _ := destination.GetAll()
+	assert.Equal(t, before, after)
+	sourceAuths, _ := source.GetAll()
+	assert.Len(t, sourceAuths, 5)
+
+	var out bytes.Buffer
+	assert.NoError(t, writeMigrationReport(&out, results, migrationOptions{dryRun: true}))
+	assert.Contains(t, out.String(), "copied.azurecr.io  copied")
+	assert.Contains(t, out.String(), "Dry run")
+}
+
+func TestMigrateCredentialsPurgesMigratedOnly(t *testing.T) {
+	source, destination := newMigrationStores()
+	results, err := migrateCredentials(source, destination, migrationOptions{conflict: keepNewer, purge: true})
+	assert.NoError(t, err)
+
+	sourceAuths, _ := source.GetAll()
+	var remaining []string
+	for server := range sourceAuths {
+		remaining = append(remaining, server)
+	}
+	sort.Strings(remaining)
+	assert.Equal(t, []string{"docker.io", "older.azurecr.io"}, remaining)
+	for _, result := range results {
+		assert.Equal(t, result.action != migrationKept, result.purged, result.server)
+	}
+
+	var out bytes.Buffer
+	assert.NoError(t, writeMigrationReport(&out, results, migrationOptions{}))
+	assert.Contains(t, out.String(), "the expiry of the credentials cannot be compared, the source was not purged")
+}
+
+func TestMigrateCommand(t *testing.T) {
+	config, cleanup := newTestDockerConfig(t)
+	defer cleanup()
+	token := makeAcrToken(time.Now().Add(time.Hour), "tenant", "credential")
+	content := `{
+    "auths": {
+        "myregistry.azurecr.io": {"identitytoken": "` + token + `"},
+        "empty.azurecr.io": {}
+    },
+    "proxies": {"default": {"httpProxy": "http://proxy.example.com:3128"}},
+    "currentContext": "remote"
+}
+`
+	assert.NoError(t, ioutil.WriteFile(config.Filename, []byte(content), 0600))
+	assert.NoError(t, config.LoadFromReader(strings.NewReader(content)))
+
+	var out bytes.Buffer
+	cmd := newAdminCommand(&storeWrapper{dockerConfig: config}, &out)
+	cmd.SetArgs([]string{"migrate", "--from", dockerConfigBackend, "--to", fileBackend, "--purge"})
+	assert.NoError(t, cmd.Execute())
+	assert.Contains(t, out.String(), "myregistry.azurecr.io")
+	assert.NotContains(t, config.AuthConfigs, "myregistry.azurecr.io")
+	// the purged entry is removed in place, the members the vendored
+	// configfile does not know are kept
+	purged, err := ioutil.ReadFile(config.Filename)
+	assert.NoError(t, err)
+	assert.Equal(t, `{
+    "auths": {
+        "empty.azurecr.io": {}
+    },
+    "proxies": {"default": {"httpProxy": "http://proxy.example.com:3128"}},
+    "currentContext": "remote"
+}
+`, string(purged))
+
+	auth, err := newLockedFileStore(secondaryFileStorePath(config)).Get("myregistry.azurecr.io")
+	assert.NoError(t, err)
+	assert.Equal(t, token, auth.IdentityToken)
+
+	cmd.SetArgs([]string{"migrate", "--from", fileBackend, "--to", fileBackend})
+	assert.Error(t, cmd.Execute())
+	cmd.SetArgs([]string{"migrate", "--from", fileBackend, "--to", dockerConfigBackend, "--conflict", keepSource})
+	assert.Error(t, cmd.Execute())
+}
+
+func TestRemoveConfigAuth(t *testing.T) {
+	testCases := []struct {
+		content  string
+		expected string
+	}{
+		{`{"auths": {"a": {}, "b": {}, "c": {}}}`, `{"auths": {"a": {}, "c": {}}}`},
+		{`{"auths": {"a": {}, "b": {}}}`, `{"auths": {"a": {}}}`},
+		{"{\r\n\t\"auths\": {\r\n\t\t\"b\": {}\r\n\t}\r\n}", "{\r\n\t\"auths\": {}\r\n}"},
+		{`{"auths": {"b": {}, "a": {}, "b": {"auth": "x"}}}`, `{"auths": {"a": {}}}`},
+		{`{"auths": {"a": {}}, "b": {}}`, `{"auths": {"a": {}}, "b": {}}`},
+		{`{"credsStore": "acr-linux"}`, `{"credsStore": "acr-linux"}`},
+	}
+	for _, tc := range testCases {
+		edited, err := removeConfigAuth([]byte(tc.content), "b")
+		assert.NoError(t, err, tc.content)
+		assert.Equal(t, tc.expected, string(edited), tc.content)
+	}
+	_, err := removeConfigAuth([]byte(`{"auths": {`), "b")
+	assert.Error(t, err)
+}
@@ -0,0 +1,21 @@
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// checkPrivatePermissions fails when the file may be accessed by users other
+// than its owner. Errors of stat are returned as is.
+func checkPrivatePermissions(path string) error {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if mode := fileInfo.Mode().Perm(); mode&0077 != 0 {
+		return fmt.Errorf("Permissions %04o of %s are too open, it must only be accessible by its owner. Please run 'chmod 600 %s'", mode, path, path)
+	}
+	return nil
+}
@@ -1,24 +1,30 @@
 package main
 
 import (
-	"os/exec"
-
 	"fmt"
 	"os"
+	"strings"
 
 	"path/filepath"
 
+	"github.com/Sirupsen/logrus"
 	dockerCommand "github.com/docker/cli/cli/command"
 	cliconfig "github.com/docker/cli/cli/config"
 	"github.com/docker/cli/cli/config/configfile"
 	dockerCredentials "github.com/docker/cli/cli/config/credentials"
 	helperCredentials "github.com/docker/docker-credential-helpers/credentials"
 	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/homedir"
 	"github.com/docker/docker/pkg/term"
 )
 
 type storeWrapper struct {
 	store *dockerCredentials.Store
+	// backend describes where the store keeps the credentials
+	backend string
+	// dockerConfig is the docker config file the store was opened for
+	dockerConfig *configfile.ConfigFile
+	tokenSource  TokenSource
 }
 
 const tokenUsername = "<token>"
@@ -46,20 +52,79 @@ func (w *storeWrapper) Get(serverURL string) (string, string, error) {
 	user, cred, err := w.getFromStore(serverURL)
 	if user == tokenUsername {
 		// no password/token is saved
+		if cred == "" && w.canLoginWithTokenSource(serverURL) {
+			return w.loginWithTokenSource(serverURL)
+		}
 		if cred == "" {
 			// pass through
 			return "", "", nil
 			// NOTE: currently docker calls Get from credstore even if the
-			// user passes -u and -p. If we enable interactive login during
-			// Get, this will result in docker prompt for interactive login
-			// even if -u -p. Make sure that docker stop calling Get when -u
-			// and -p before we can even think about enable interactive login
+			// user passes -u and -p. Interactive login during Get would
+			// result in a device code prompt even with -u -p, which is why
+			// it is only done when the user opts in with
+			// DOCKER_CREDENTIAL_ACR_DEVICE_LOGIN
 		}
+		storedCred := cred
 		user, cred, err = GetUsernamePassword(serverURL, cred)
+		if err == nil && cred != "" && cred != storedCred {
+			w.persistRefreshToken(serverURL, cred)
+		}
 	}
 	return user, cred, err
 }
 
+// canLoginWithTokenSource reports whether a token source is configured and may
+// be used for the server. Login is only attempted for ACR hosts, so lookups of
+// other registries never wait on a challenge round trip.
+func (w *storeWrapper) canLoginWithTokenSource(serverURL string) bool {
+	return w.tokenSource != nil && isAcrLoginServer(serverURL)
+}
+
+// loginWithTokenSource acquires a new refresh token from the configured token
+// source and stores it in place of the missing one
+func (w *storeWrapper) loginWithTokenSource(serverURL string) (string, string, error) {
+	refreshToken, err := acquireRefreshToken(serverURL, w.tokenSource)
+	if isNonAcrChallenge(err) {
+		// pass through
+		return "", "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+	w.persistRefreshToken(serverURL, refreshToken)
+	return tokenUsername, refreshToken, nil
+}
+
+// persistRefreshToken writes a freshly exchanged refresh token back into the
+// store so that subsequent calls can use it until it is near expiry again. The
+// store is the credential backend alone, the docker config file is left as is.
+// Failure to persist is not fatal since the token is still valid for this call.
+func (w *storeWrapper) persistRefreshToken(serverURL string, refreshToken string) {
+	acrToken, err := parseAcrToken(refreshToken)
+	if err != nil {
+		logrus.Infof("[Azure Login Helper] refreshed token for %s is not a valid ACR token, not caching it. error: %s\n", serverURL, err)
+		return
+	}
+	if acrToken.isExpiredOrNear() {
+		return
+	}
+	if err = w.storeToken(serverURL, refreshToken); err != nil {
+		logrus.Infof("[Azure Login Helper] unable to cache refreshed token for %s, error: %s\n", serverURL, err)
+		return
+	}
+	logrus.WithFields(tokenExpiryFields(acrToken)).WithField("server", serverURL).Debug("Cached refreshed token")
+}
+
+// storeToken saves an identity token in the credential backend. Helper backends
+// are opened with newHelperStore, so the docker config file is never written.
+func (w *storeWrapper) storeToken(serverURL string, identityToken string) error {
+	store := *w.store
+	return store.Store(dockerTypes.AuthConfig{
+		ServerAddress: serverURL,
+		Username:      tokenUsername,
+		IdentityToken: identityToken,
+	})
+}
+
 func (w *storeWrapper) getFromStore(serverURL string) (string, string, error) {
 	store := *w.store
 	cred, err := store.Get(serverURL)
@@ -94,94 +159,150 @@ func (w *storeWrapper) List() (map[string]string, error) {
 	return results, nil
 }
 
-func getCredentialsStore() (*dockerCredentials.Store, error) {
-	_, _, stderr := term.StdStreams()
-	// NOTE: This tool would always use the default config file location currently
-	config := dockerCommand.LoadDefaultConfigFile(stderr)
-	if config == nil {
-		return nil, fmt.Errorf("Problem loading docker config file at default location")
-	}
-	// NOTE: This tool would always use wincred for windows
-	// secretservice for linux
-	// osxkeychain for osx
-	// if they are found. Otherwise it would revert to using native
-	if helperSuffix != "" && configHelperFound() {
-		store := dockerCredentials.NewNativeStore(config, helperSuffix)
-		return &store, nil
-	}
-
-	return newSecondaryFileStore(config)
-}
-
-func newSecondaryFileStore(config *configfile.ConfigFile) (store *dockerCredentials.Store, err error) {
-	configdir := filepath.Dir(config.Filename)
-	secondarydir := filepath.Join(configdir, "acr")
-	var fileInfo os.FileInfo
-	var secondaryConfig *configfile.ConfigFile
-	if fileInfo, err = os.Stat(secondarydir); err != nil {
-		if os.IsNotExist(err) {
-			err = os.Mkdir(secondarydir, 0777)
-			if err != nil {
-				return nil, fmt.Errorf("Failed to create secondary file store dir %s", secondarydir)
-			}
-			secondaryConfig = getEmptyConfig(secondarydir)
-		} else {
-			return nil, fmt.Errorf("Failed to stat dir %s", secondarydir)
-		}
-	} else {
-		if !fileInfo.IsDir() {
-			return nil, fmt.Errorf("Failed to create secondary file store dir %s, a file already exist in its location", secondarydir)
-		}
-		secondaryConfig, err = cliconfig.Load(secondarydir)
-		if err != nil {
-			_, statError := os.Stat(filepath.Join(secondarydir, "config.json"))
-			if os.IsNotExist(statError) {
-				secondaryConfig = getEmptyConfig(secondarydir)
-			} else {
-				return nil, fmt.Errorf("Failed to load existing config from %s, error: %s", secondarydir, err)
-			}
-		}
+const (
+	envDockerConfig = "DOCKER_CONFIG"
+	configOption    = "--config"
+)
+
+// dockerConfigDir returns the docker config directory the way the docker CLI
+// resolves it: the --config option, then DOCKER_CONFIG, then .docker in the
+// home directory
+func dockerConfigDir(configDir string) string {
+	if configDir != "" {
+		return configDir
+	}
+	if configDir = os.Getenv(envDockerConfig); configDir != "" {
+		return configDir
 	}
+	return filepath.Join(homedir.Get(), ".docker")
+}
 
-	// THIS IS REALLY INEFFICIENT...
-	var oldCreds map[string]dockerTypes.AuthConfig
-	oldStore := dockerCredentials.NewFileStore(config)
-	oldCreds, err = oldStore.GetAll()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error retrieving old credentials, skipping credentials sync. Error: %s", err)
-	} else {
-		for server, oldCred := range oldCreds {
-			if _, found := secondaryConfig.AuthConfigs[server]; !found {
-				secondaryConfig.AuthConfigs[server] = oldCred
-				// note that the oldCreds would be wiped by docker as a side effect
+// extractConfigOption removes the --config option from the arguments, returning
+// its value along with the remaining arguments. Docker never passes it to
+// credential helpers, it is meant for running the admin commands by hand.
+func extractConfigOption(args []string) (string, []string, error) {
+	var configDir string
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == configOption:
+			if i+1 == len(args) {
+				return "", nil, fmt.Errorf("Missing directory after %s", configOption)
 			}
+			i++
+			configDir = args[i]
+		case strings.HasPrefix(args[i], configOption+"="):
+			configDir = strings.TrimPrefix(args[i], configOption+"=")
+		default:
+			rest = append(rest, args[i])
 		}
 	}
-	secondaryFileStore := dockerCredentials.NewFileStore(secondaryConfig)
-	return &secondaryFileStore, nil
+	return configDir, rest, nil
 }
 
-func getEmptyConfig(dir string) *configfile.ConfigFile {
-	return &configfile.ConfigFile{
-		Filename:    filepath.Join(dir, "config.json"),
-		AuthConfigs: map[string]dockerTypes.AuthConfig{},
+// loadDockerConfig loads the docker config file the credential stores keep
+// their files next to
+func loadDockerConfig() (*configfile.ConfigFile, error) {
+	_, _, stderr := term.StdStreams()
+	config := dockerCommand.LoadDefaultConfigFile(stderr)
+	if config == nil {
+		return nil, fmt.Errorf("Problem loading docker config file in %s", cliconfig.Dir())
 	}
+	return config, nil
 }
 
-func configHelperFound() bool {
-	helperName := "docker-credential-" + helperSuffix
-	lookupCmd := exec.Command(exeFinder, helperName)
-	err := lookupCmd.Run()
-	return err == nil
+// secondaryFileStoreDir is the acr directory next to the docker config file
+// holding the secondary file stores
+func secondaryFileStoreDir(config *configfile.ConfigFile) string {
+	return filepath.Join(filepath.Dir(config.Filename), "acr")
+}
+
+// secondaryFileStorePath is the file of the plain secondary file store
+func secondaryFileStorePath(config *configfile.ConfigFile) string {
+	return filepath.Join(secondaryFileStoreDir(config), "config.json")
+}
+
+// encryptedFileStorePath is the file of the encrypted secondary file store
+func encryptedFileStorePath(config *configfile.ConfigFile) string {
+	return filepath.Join(secondaryFileStoreDir(config), encryptedStoreFile)
+}
+
+// newSecondaryFileStore prepares a secondary file store, creating its directory.
+// Credentials left in the docker config file are not copied, that is done once
+// with the migrate command.
+func newSecondaryFileStore(config *configfile.ConfigFile, secondaryStore *lockedFileStore) (*dockerCredentials.Store, error) {
+	secondarydir := secondaryFileStoreDir(config)
+	if fileInfo, err := os.Stat(secondarydir); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Failed to stat dir %s", secondarydir)
+		}
+		if err = os.Mkdir(secondarydir, 0700); err != nil {
+			return nil, fmt.Errorf("Failed to create secondary file store dir %s", secondarydir)
+		}
+	} else if !fileInfo.IsDir() {
+		return nil, fmt.Errorf("Failed to create secondary file store dir %s, a file already exist in its location", secondarydir)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"file":      secondaryStore.filename,
+		"encrypted": secondaryStore.codec != nil,
+	}).Debug("Using secondary file credential store")
+	var store dockerCredentials.Store = secondaryStore
+	return &store, nil
 }
 
 func main() {
-	store, err := getCredentialsStore()
+	configDir, args, err := extractConfigOption(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	cliconfig.SetDir(dockerConfigDir(configDir))
+	// the credential helper protocol reads the action from os.Args
+	os.Args = append(os.Args[:1], args...)
+
+	logFile, err := setupLogging()
 	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up logging: %s\n", err)
+		os.Exit(1)
+	}
+	defer logFile.Close()
+	if settings, err = loadHelperConfig(helperConfigPath()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading credential helper config: %s\n", err)
+		os.Exit(1)
+	}
+	if client, err = newHTTPClient(settings.HTTP); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating http client: %s\n", err)
+		os.Exit(1)
+	}
+	if retry, err = newRetryPolicy(settings.Retry); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating retry policy: %s\n", err)
+		os.Exit(1)
+	}
+	wrapper := &storeWrapper{}
+	cmd := newAdminCommand(wrapper, os.Stdout)
+	admin := isAdminCommand(cmd, os.Args[1:])
+	if wrapper.dockerConfig, err = loadDockerConfig(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error creating credential store helper: %s\n", err)
 		os.Exit(1)
 	}
-	helperCredentials.Serve(&storeWrapper{
-		store: store,
-	})
+	// the admin commands probe the credential helpers again, while the
+	// lookups of docker reuse recent probes
+	if wrapper.store, wrapper.backend, err = selectStoreBackend(wrapper.dockerConfig, settings.Store, admin); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating credential store helper: %s\n", err)
+		os.Exit(1)
+	}
+	// the AZURE_* variables may be meant for other tools, so an incomplete set
+	// only turns off the login with a token source
+	if wrapper.tokenSource, err = newTokenSourceFromEnv(); err != nil {
+		logrus.WithError(err).Warn("Not logging in with an AAD token source")
+	}
+	if admin {
+		if err = cmd.Execute(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	helperCredentials.Serve(wrapper)
 }
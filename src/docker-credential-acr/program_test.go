@@ -0,0 +1,401 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cliconfig "github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	dockerCredentials "github.com/docker/cli/cli/config/credentials"
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/homedir"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryStore is an in memory dockerCredentials.Store used in tests
+type memoryStore struct {
+	mutex sync.Mutex
+	auths map[string]dockerTypes.AuthConfig
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{auths: map[string]dockerTypes.AuthConfig{}}
+}
+
+func (s *memoryStore) Erase(serverAddress string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.auths, serverAddress)
+	return nil
+}
+
+func (s *memoryStore) Get(serverAddress string) (dockerTypes.AuthConfig, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.auths[serverAddress], nil
+}
+
+func (s *memoryStore) GetAll() (map[string]dockerTypes.AuthConfig, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := make(map[string]dockerTypes.AuthConfig)
+	for k, v := range s.auths {
+		result[k] = v
+	}
+	return result, nil
+}
+
+func (s *memoryStore) Store(authConfig dockerTypes.AuthConfig) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.auths[authConfig.ServerAddress] = authConfig
+	return nil
+}
+
+func newTestWrapper(store dockerCredentials.Store) *storeWrapper {
+	return &storeWrapper{store: &store}
+}
+
+// makeAcrToken builds an unsigned token carrying an acrTokenPayload
+func makeAcrToken(expiration time.Time, tenant string, credential string) string {
+	payload, _ := json.Marshal(acrTokenPayload{
+		Expiration: expiration.Unix(),
+		TenantID:   tenant,
+		Credential: credential,
+	})
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	return fmt.Sprintf("%s.%s.", header, base64.RawURLEncoding.EncodeToString(payload))
+}
+
+// fakeRegistry is a TLS test server answering the ACR challenge and token exchange
+type fakeRegistry struct {
+	server    *httptest.Server
+	mutex     sync.Mutex
+	exchanges int
+	lastForm  url.Values
+	lastPath  string
+	newToken  string
+	challenge string
+	// challengeStatus answers the challenge with the status instead of 401 when set
+	challengeStatus int
+	// exchangeStatus makes the exchange fail with the status when set
+	exchangeStatus int
+}
+
+func newFakeRegistry(newToken string) *fakeRegistry {
+	registry := &fakeRegistry{newToken: newToken}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		challenge := registry.challenge
+		if challenge == "" {
+			challenge = fmt.Sprintf(`Bearer realm="https://%s/oauth2/token",service="%s"`, r.Host, r.Host)
+		}
+		if registry.challengeStatus != 0 {
+			w.WriteHeader(registry.challengeStatus)
+			return
+		}
+		w.Header().Set("Www-Authenticate", challenge)
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/exchange") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		registry.mutex.Lock()
+		registry.exchanges++
+		registry.lastForm = r.PostForm
+		registry.lastPath = r.URL.Path
+		registry.mutex.Unlock()
+		if registry.exchangeStatus != 0 {
+			w.WriteHeader(registry.exchangeStatus)
+			return
+		}
+		switch r.PostForm.Get("grant_type") {
+		case "refresh_token", "access_token":
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(acrAuthResponse{RefreshToken: registry.newToken})
+	})
+	registry.server = httptest.NewTLSServer(mux)
+	return registry
+}
+
+func (r *fakeRegistry) host() string {
+	u, _ := url.Parse(r.server.URL)
+	return u.Host
+}
+
+func (r *fakeRegistry) exchangeCount() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.exchanges
+}
+
+func (r *fakeRegistry) Close() {
+	r.server.Close()
+}
+
+// useInsecureClient points the package http client at test servers
+func useInsecureClient() func() {
+	oldClient := client
+	client = &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	return func() { client = oldClient }
+}
+
+func TestGetCachesRefreshedToken(t *testing.T) {
+	defer useInsecureClient()()
+	refreshed := makeAcrToken(time.Now().Add(3*time.Hour), "tenant", "new")
+	registry := newFakeRegistry(refreshed)
+	defer registry.Close()
+
+	store := newMemoryStore()
+	store.Store(dockerTypes.AuthConfig{
+		ServerAddress: registry.host(),
+		Username:      tokenUsername,
+		IdentityToken: makeAcrToken(time.Now().Add(-time.Hour), "tenant", "old"),
+	})
+	wrapper := newTestWrapper(store)
+
+	for i := 0; i < 3; i++ {
+		user, cred, err := wrapper.Get(registry.host())
+		assert.NoError(t, err)
+		assert.Equal(t, tokenUsername, user)
+		assert.Equal(t, refreshed, cred)
+	}
+
+	assert.Equal(t, 1, registry.exchangeCount())
+	assert.Equal(t, refreshed, store.auths[registry.host()].IdentityToken)
+}
+
+// dockerConfigWithSettings is a docker config file with settings the vendored
+// configfile does not know, in a layout it would not write
+const dockerConfigWithSettings = `{
+    "proxies": {"default": {"httpProxy": "http://proxy.example.com:3128"}},
+    "currentContext": "remote",
+    "credsStore": "acr-linux"
+}
+`
+
+// newTestDockerConfigFile writes dockerConfigWithSettings as the docker config
+// file, see assertDockerConfigUntouched
+func newTestDockerConfigFile(t *testing.T) (*configfile.ConfigFile, func()) {
+	config, cleanup := newTestDockerConfig(t)
+	assert.NoError(t, ioutil.WriteFile(config.Filename, []byte(dockerConfigWithSettings), 0600))
+	return config, cleanup
+}
+
+func assertDockerConfigUntouched(t *testing.T, config *configfile.ConfigFile) {
+	content, err := ioutil.ReadFile(config.Filename)
+	assert.NoError(t, err)
+	assert.Equal(t, dockerConfigWithSettings, string(content))
+}
+
+func TestGetLeavesDockerConfigUntouched(t *testing.T) {
+	defer useInsecureClient()()
+	refreshed := makeAcrToken(time.Now().Add(3*time.Hour), "tenant", "new")
+	registry := newFakeRegistry(refreshed)
+	defer registry.Close()
+	_, restore := useSizeLimitedHelper(t, 100000)
+	defer restore()
+	config, cleanup := newTestDockerConfigFile(t)
+	defer cleanup()
+
+	store, _, err := selectStoreBackend(config, storeConfig{Backends: []string{"sizelimited"}}, false)
+	assert.NoError(t, err)
+	assert.NoError(t, (*store).Store(dockerTypes.AuthConfig{
+		ServerAddress: registry.host(),
+		Username:      tokenUsername,
+		IdentityToken: makeAcrToken(time.Now().Add(-time.Hour), "tenant", "old"),
+	}))
+	wrapper := &storeWrapper{store: store}
+
+	_, cred, err := wrapper.Get(registry.host())
+	assert.NoError(t, err)
+	assert.Equal(t, refreshed, cred)
+	auth, err := (*store).Get(registry.host())
+	assert.NoError(t, err)
+	assert.Equal(t, refreshed, auth.IdentityToken)
+	assertDockerConfigUntouched(t, config)
+}
+
+func TestGetDoesNotCacheNearExpiryToken(t *testing.T) {
+	defer useInsecureClient()()
+	refreshed := makeAcrToken(time.Now().Add(time.Minute), "tenant", "new")
+	registry := newFakeRegistry(refreshed)
+	defer registry.Close()
+
+	expired := makeAcrToken(time.Now().Add(-time.Hour), "tenant", "old")
+	store := newMemoryStore()
+	store.Store(dockerTypes.AuthConfig{
+		ServerAddress: registry.host(),
+		Username:      tokenUsername,
+		IdentityToken: expired,
+	})
+	wrapper := newTestWrapper(store)
+
+	_, cred, err := wrapper.Get(registry.host())
+	assert.NoError(t, err)
+	assert.Equal(t, refreshed, cred)
+	assert.Equal(t, expired, store.auths[registry.host()].IdentityToken)
+}
+
+func TestGetPassesThroughNonAcrRegistries(t *testing.T) {
+	defer useInsecureClient()()
+	testCases := []struct {
+		challenge     string
+		identityToken string
+		// serverURL formats the key docker looks the registry up by
+		serverURL string
+	}{
+		{
+			challenge:     `Basic realm="Registry Realm"`,
+			identityToken: makeAcrToken(time.Now().Add(-time.Hour), "tenant", "old"),
+		},
+		{
+			challenge:     `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`,
+			identityToken: "opaque-identity-token",
+			serverURL:     "https://%s/v1/",
+		},
+		{
+			challenge:     `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`,
+			identityToken: makeAcrToken(time.Now().Add(-time.Hour), "tenant", "old"),
+		},
+		{
+			challenge:     `Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:user/image:pull"`,
+			identityToken: "opaque-identity-token",
+		},
+		{
+			challenge:     `Bearer realm="https://harbor.example.com/service/token",service="harbor-registry"`,
+			identityToken: "opaque-identity-token",
+		},
+	}
+	for _, tc := range testCases {
+		registry := newFakeRegistry("")
+		registry.challenge = tc.challenge
+		serverURL := registry.host()
+		if tc.serverURL != "" {
+			serverURL = fmt.Sprintf(tc.serverURL, registry.host())
+		}
+		store := newMemoryStore()
+		store.Store(dockerTypes.AuthConfig{
+			ServerAddress: serverURL,
+			Username:      tokenUsername,
+			IdentityToken: tc.identityToken,
+		})
+		wrapper := newTestWrapper(store)
+
+		user, cred, err := wrapper.Get(serverURL)
+		assert.NoError(t, err, tc.challenge)
+		assert.Equal(t, tokenUsername, user, tc.challenge)
+		assert.Equal(t, tc.identityToken, cred, tc.challenge)
+		assert.Equal(t, 0, registry.exchangeCount(), tc.challenge)
+		registry.Close()
+	}
+}
+
+func TestGetRejectsBadTokenForAcrRegistry(t *testing.T) {
+	defer useInsecureClient()()
+	registry := newFakeRegistry("")
+	defer registry.Close()
+	store := newMemoryStore()
+	store.Store(dockerTypes.AuthConfig{
+		ServerAddress: registry.host(),
+		Username:      tokenUsername,
+		IdentityToken: "opaque-identity-token",
+	})
+	wrapper := newTestWrapper(store)
+
+	_, _, err := wrapper.Get(registry.host())
+	assert.Error(t, err)
+}
+
+func TestGetReturnsStoredPassword(t *testing.T) {
+	store := newMemoryStore()
+	store.Store(dockerTypes.AuthConfig{
+		ServerAddress: "ghcr.io",
+		Username:      "user",
+		Password:      "password",
+	})
+	wrapper := newTestWrapper(store)
+
+	user, cred, err := wrapper.Get("ghcr.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "user", user)
+	assert.Equal(t, "password", cred)
+}
+
+func TestDockerConfigDir(t *testing.T) {
+	defer os.Setenv(envDockerConfig, os.Getenv(envDockerConfig))
+	os.Unsetenv(envDockerConfig)
+	assert.Equal(t, filepath.Join(homedir.Get(), ".docker"), dockerConfigDir(""))
+	os.Setenv(envDockerConfig, "/workspace/.docker")
+	assert.Equal(t, "/workspace/.docker", dockerConfigDir(""))
+	assert.Equal(t, "/custom", dockerConfigDir("/custom"))
+}
+
+func TestExtractConfigOption(t *testing.T) {
+	testCases := []struct {
+		args      []string
+		configDir string
+		rest      []string
+	}{
+		{[]string{"get"}, "", []string{"get"}},
+		{[]string{"--config", "/custom", "status", "--json"}, "/custom", []string{"status", "--json"}},
+		{[]string{"status", "--config=/custom"}, "/custom", []string{"status"}},
+	}
+	for _, tc := range testCases {
+		configDir, rest, err := extractConfigOption(tc.args)
+		assert.NoError(t, err, "%v", tc.args)
+		assert.Equal(t, tc.configDir, configDir, "%v", tc.args)
+		assert.Equal(t, tc.rest, rest, "%v", tc.args)
+	}
+	_, _, err := extractConfigOption([]string{"status", "--config"})
+	assert.Error(t, err)
+}
+
+func TestLoadDockerConfigFromConfigDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acr-docker-config-dir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"credHelpers": {"myregistry.azurecr.io": "acr-linux"}}`), 0600)
+	assert.NoError(t, err)
+	defer cliconfig.SetDir(cliconfig.Dir())
+	cliconfig.SetDir(dir)
+	defer os.Setenv(envHelperConfig, os.Getenv(envHelperConfig))
+	os.Unsetenv(envHelperConfig)
+
+	config, err := loadDockerConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "config.json"), config.Filename)
+	assert.Equal(t, "acr-linux", config.CredentialHelpers["myregistry.azurecr.io"])
+	assert.Equal(t, filepath.Join(dir, "acr", "config.json"), secondaryFileStorePath(config))
+	assert.Equal(t, filepath.Join(dir, "acr", "helper.json"), helperConfigPath())
+
+	store, backend, err := selectStoreBackend(config, storeConfig{Backends: []string{fileBackend}}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, secondaryFileStorePath(config), backend)
+	assert.NoError(t, (*store).Store(dockerTypes.AuthConfig{ServerAddress: "myregistry.azurecr.io", Username: "user", Password: "password"}))
+	_, err = os.Stat(filepath.Join(dir, "acr", "config.json"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const defaultRefreshParallelism = 4
+
+// refresh outcomes reported per registry
+const (
+	refreshSucceeded = "refreshed"
+	refreshSkipped   = "skipped"
+	refreshFailed    = "failed"
+)
+
+// refreshResult is the outcome of refreshing the token of a single registry
+type refreshResult struct {
+	server string
+	result string
+	// expiry of the rotated token when refreshed
+	expiry time.Time
+	// reason a registry was skipped
+	reason string
+	err    error
+}
+
+func newRefreshAllCommand(wrapper *storeWrapper, out io.Writer) *cobra.Command {
+	var parallelism int
+	cmd := &cobra.Command{
+		Use:   "refresh-all",
+		Short: "Renew every stored ACR token.",
+		Long:  "Exchange every stored ACR identity token for a new one and store it, regardless of its expiry.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if parallelism < 1 {
+				return fmt.Errorf("Invalid parallelism %d, it must be at least 1", parallelism)
+			}
+			results, err := wrapper.refreshAll(parallelism)
+			if err != nil {
+				return err
+			}
+			if err = writeRefreshSummary(out, results); err != nil {
+				return err
+			}
+			failed := 0
+			for _, result := range results {
+				if result.result == refreshFailed {
+					failed++
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("Failed to refresh the tokens of %d of %d registries", failed, len(results))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().IntVar(&parallelism, "parallel", defaultRefreshParallelism, "Number of registries to refresh at the same time.")
+	return cmd
+}
+
+// refreshAll refreshes the identity token of every registry in the store, at
+// most parallelism at a time, and writes the rotated tokens back. The results
+// are sorted by server.
+func (w *storeWrapper) refreshAll(parallelism int) ([]refreshResult, error) {
+	store := *w.store
+	auths, err := store.GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("Error listing stored credentials, error: %s", err)
+	}
+
+	var (
+		wait       sync.WaitGroup
+		mutex      sync.Mutex
+		storeMutex sync.Mutex
+		results    []refreshResult
+	)
+	slots := make(chan struct{}, parallelism)
+	for server, auth := range auths {
+		if auth.IdentityToken == "" || (auth.Username != "" && auth.Username != tokenUsername) {
+			continue
+		}
+		wait.Add(1)
+		go func(server string, identityToken string) {
+			defer wait.Done()
+			slots <- struct{}{}
+			result := w.refreshToken(server, identityToken, &storeMutex)
+			<-slots
+
+			mutex.Lock()
+			results = append(results, result)
+			mutex.Unlock()
+		}(server, auth.IdentityToken)
+	}
+	wait.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].server < results[j].server
+	})
+	return results, nil
+}
+
+// refreshToken exchanges the identity token of a registry for a new one and
+// stores it. Writes to the store are serialized with storeMutex since stores
+// are not safe for concurrent use.
+func (w *storeWrapper) refreshToken(server string, identityToken string, storeMutex *sync.Mutex) refreshResult {
+	result := refreshResult{server: server, result: refreshFailed}
+	acrToken, err := parseAcrToken(identityToken)
+	if err != nil {
+		result.result = refreshSkipped
+		result.reason = "not an ACR token"
+		return result
+	}
+	// auths may be keyed by URLs such as https://myregistry.azurecr.io, the
+	// refreshed token is stored under the key docker looks up
+	host := registryHost(server)
+	challenge, err := receiveChallengeFromLoginServer(host)
+	if isNonAcrChallenge(err) {
+		result.result = refreshSkipped
+		result.reason = "not an ACR registry"
+		return result
+	} else if err != nil {
+		result.err = err
+		return result
+	}
+	refreshToken, err := performTokenExchange(host, challenge, acrToken.TenantID, acrToken.Credential)
+	if err != nil {
+		if !isRegistryUnreachable(err) && !isRegistryUnavailable(err) {
+			err = &tokenExpiredError{server: server, cause: err}
+		}
+		result.err = err
+		return result
+	}
+	if result.err = verifyTenant(server, acrToken.TenantID, refreshToken); result.err != nil {
+		return result
+	}
+	refreshed, err := parseAcrToken(refreshToken)
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	storeMutex.Lock()
+	err = w.storeToken(server, refreshToken)
+	storeMutex.Unlock()
+	if err != nil {
+		result.err = fmt.Errorf("Unable to store the refreshed token, error: %s", err)
+		return result
+	}
+	logrus.WithFields(tokenExpiryFields(refreshed)).WithField("server", server).Debug("Stored refreshed token")
+	result.result = refreshSucceeded
+	result.expiry = time.Unix(refreshed.Expiration, 0)
+	return result
+}
+
+func writeRefreshSummary(out io.Writer, results []refreshResult) error {
+	table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "SERVER\tRESULT\tDETAILS")
+	for _, result := range results {
+		var details string
+		switch result.result {
+		case refreshSucceeded:
+			details = "expires " + result.expiry.UTC().Format(time.RFC3339)
+		case refreshSkipped:
+			details = result.reason
+		default:
+			details = result.err.Error()
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\n", result.server, result.result, details)
+	}
+	return table.Flush()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefreshAll(t *testing.T) {
+	defer useInsecureClient()()
+	_, restore := useTestRetry(1)
+	defer restore()
+
+	var registries []*fakeRegistry
+	newRegistry := func(newToken string) *fakeRegistry {
+		registry := newFakeRegistry(newToken)
+		registries = append(registries, registry)
+		return registry
+	}
+	defer func() {
+		for _, registry := range registries {
+			registry.Close()
+		}
+	}()
+
+	expiry := time.Now().Add(3 * time.Hour)
+	store := newMemoryStore()
+	var refreshed []*fakeRegistry
+	for i := 0; i < 5; i++ {
+		registry := newRegistry(makeAcrToken(expiry, "tenant", "new"))
+		refreshed = append(refreshed, registry)
+		store.Store(dockerTypes.AuthConfig{
+			ServerAddress: registry.host(),
+			Username:      tokenUsername,
+			IdentityToken: makeAcrToken(time.Now().Add(time.Hour), "tenant", "old"),
+		})
+	}
+	failing := newRegistry("")
+	failing.exchangeStatus = http.StatusUnauthorized
+	store.Store(dockerTypes.AuthConfig{
+		ServerAddress: failing.host(),
+		Username:      tokenUsername,
+		IdentityToken: makeAcrToken(time.Now().Add(-time.Hour), "tenant", "old"),
+	})
+	nonAcr := newRegistry("")
+	nonAcr.challenge = `Basic realm="Registry Realm"`
+	store.Store(dockerTypes.AuthConfig{
+		ServerAddress: nonAcr.host(),
+		Username:      tokenUsername,
+		IdentityToken: makeAcrToken(time.Now().Add(-time.Hour), "tenant", "old"),
+	})
+	store.Store(dockerTypes.AuthConfig{
+		ServerAddress: "docker.io",
+		Username:      "user",
+		Password:      "password",
+	})
+
+	var out bytes.Buffer
+	cmd := newAdminCommand(newTestWrapper(store), &out)
+	cmd.SetArgs([]string{"refresh-all", "--parallel", "2"})
+	err := cmd.Execute()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "1 of 7")
+
+	summary := out.String()
+	for _, registry := range refreshed {
+		assert.Equal(t, 1, registry.exchangeCount())
+		assert.Equal(t, makeAcrToken(expiry, "tenant", "new"), store.auths[registry.host()].IdentityToken)
+		assert.Regexp(t, registry.host()+` +refreshed +expires`, summary)
+	}
+	assert.Regexp(t, failing.host()+` +failed`, summary)
+	assert.Regexp(t, nonAcr.host()+` +skipped +not an ACR registry`, summary)
+	assert.Equal(t, 0, nonAcr.exchangeCount())
+	assert.NotContains(t, summary, "docker.io")
+	assert.Equal(t, "password", store.auths["docker.io"].Password)
+	assert.Equal(t, 8, len(strings.Split(strings.TrimSpace(summary), "\n")))
+}
+
+func TestRefreshAllSucceeds(t *testing.T) {
+	defer useInsecureClient()()
+	registry := newFakeRegistry(makeAcrToken(time.Now().Add(3*time.Hour), "tenant", "new"))
+	defer registry.Close()
+
+	store := newMemoryStore()
+	store.Store(dockerTypes.AuthConfig{
+		ServerAddress: registry.host(),
+		IdentityToken: makeAcrToken(time.Now().Add(time.Hour), "tenant", "old"),
+	})
+
+	var out bytes.Buffer
+	cmd := newAdminCommand(newTestWrapper(store), &out)
+	cmd.SetArgs([]string{"refresh-all"})
+	assert.NoError(t, cmd.Execute())
+	assert.Equal(t, 1, registry.exchangeCount())
+}
+
+func TestRefreshAllWithUrlKeys(t *testing.T) {
+	defer useInsecureClient()()
+	expiry := time.Now().Add(3 * time.Hour)
+	registry := newFakeRegistry(makeAcrToken(expiry, "tenant", "new"))
+	defer registry.Close()
+
+	serverURL := "https://" + registry.host() + "/v2/"
+	store := newMemoryStore()
+	store.Store(dockerTypes.AuthConfig{
+		ServerAddress: serverURL,
+		Username:      tokenUsername,
+		IdentityToken: makeAcrToken(time.Now().Add(time.Hour), "tenant", "old"),
+	})
+
+	var out bytes.Buffer
+	cmd := newAdminCommand(newTestWrapper(store), &out)
+	cmd.SetArgs([]string{"refresh-all"})
+	assert.NoError(t, cmd.Execute())
+	assert.Equal(t, 1, registry.exchangeCount())
+	assert.Equal(t, makeAcrToken(expiry, "tenant", "new"), store.auths[serverURL].IdentityToken)
+	assert.Regexp(t, serverURL+` +refreshed +expires`, out.String())
+}
+
+func TestRefreshAllLeavesDockerConfigUntouched(t *testing.T) {
+	defer useInsecureClient()()
+	_, restore := useSizeLimitedHelper(t, 100000)
+	defer restore()
+	config, cleanup := newTestDockerConfigFile(t)
+	defer cleanup()
+	store, _, err := selectStoreBackend(config, storeConfig{Backends: []string{"sizelimited"}}, false)
+	assert.NoError(t, err)
+
+	expiry := time.Now().Add(3 * time.Hour)
+	var registries []*fakeRegistry
+	for i := 0; i < 3; i++ {
+		registry := newFakeRegistry(makeAcrToken(expiry, "tenant", "new"))
+		defer registry.Close()
+		registries = append(registries, registry)
+		assert.NoError(t, (*store).Store(dockerTypes.AuthConfig{
+			ServerAddress: registry.host(),
+			Username:      tokenUsername,
+			IdentityToken: makeAcrToken(time.Now().Add(time.Hour), "tenant", "old"),
+		}))
+	}
+
+	var out bytes.Buffer
+	cmd := newAdminCommand(&storeWrapper{store: store}, &out)
+	cmd.SetArgs([]string{"refresh-all"})
+	assert.NoError(t, cmd.Execute())
+	for _, registry := range registries {
+		auth, err := (*store).Get(registry.host())
+		assert.NoError(t, err)
+		assert.Equal(t, makeAcrToken(expiry, "tenant", "new"), auth.IdentityToken)
+	}
+	assertDockerConfigUntouched(t, config)
+}
+
+func TestRefreshAllRejectsInvalidParallelism(t *testing.T) {
+	var out bytes.Buffer
+	cmd := newAdminCommand(newTestWrapper(newMemoryStore()), &out)
+	cmd.SetArgs([]string{"refresh-all", "--parallel", "0"})
+	assert.Error(t, cmd.Execute())
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func newRekeyCommand(wrapper *storeWrapper, out io.Writer) *cobra.Command {
+	var newKeyFile string
+	var newPassphrase bool
+	cmd := &cobra.Command{
+		Use:   "rekey",
+		Short: "Encrypt the encrypted file store with a new key.",
+		Long: "Encrypt the encrypted file store with a new key. The new key is read from the file given with --new-key-file, " +
+			"which is generated when it does not exist, or derived from the passphrase in " + envStoreNewPassphrase + " with --new-passphrase.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if (newKeyFile == "") == !newPassphrase {
+				return fmt.Errorf("Please specify either --new-key-file or --new-passphrase")
+			}
+			store, ok := (*wrapper.store).(*lockedFileStore)
+			if !ok || store.codec == nil {
+				return fmt.Errorf("The credentials are kept in %s, which is not encrypted", wrapper.backend)
+			}
+
+			var key *storeKey
+			var err error
+			if newPassphrase {
+				passphrase := os.Getenv(envStoreNewPassphrase)
+				if passphrase == "" {
+					return fmt.Errorf("Please set the new passphrase in %s", envStoreNewPassphrase)
+				}
+				key = &storeKey{passphrase: passphrase}
+			} else if _, err = os.Stat(newKeyFile); err == nil {
+				key, err = readStoreKeyFile(newKeyFile)
+			} else if os.IsNotExist(err) {
+				key, err = generateStoreKeyFile(newKeyFile)
+				if err == nil {
+					fmt.Fprintf(out, "Generated a new key in %s\n", newKeyFile)
+				}
+			}
+			if err != nil {
+				return err
+			}
+
+			if err = store.rekey(key); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Encrypted %s with the new key, configure the credential helper to use it from now on\n", store.filename)
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&newKeyFile, "new-key-file", "", "File holding the new base64 encoded key, generated when it does not exist.")
+	flags.BoolVar(&newPassphrase, "new-passphrase", false, "Derive the new key from the passphrase in "+envStoreNewPassphrase+".")
+	return cmd
+}
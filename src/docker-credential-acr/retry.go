@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// retryConfig controls how failed challenge and exchange requests are retried
+type retryConfig struct {
+	// MaxAttempts is the total number of attempts of a request, 1 disables retries
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	// MinBackoff and MaxBackoff bound the wait between attempts, as durations
+	// such as "200ms". The wait doubles on each attempt with random jitter.
+	MinBackoff string `json:"minBackoff,omitempty"`
+	MaxBackoff string `json:"maxBackoff,omitempty"`
+}
+
+const (
+	defaultMaxAttempts = 3
+	defaultMinBackoff  = 200 * time.Millisecond
+	defaultMaxBackoff  = 5 * time.Second
+)
+
+// retryPolicy retries requests with exponential backoff and jitter
+type retryPolicy struct {
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+}
+
+// retry is the policy in effect, main replaces it with one from the helper config
+var retry = retryPolicy{
+	maxAttempts: defaultMaxAttempts,
+	minBackoff:  defaultMinBackoff,
+	maxBackoff:  defaultMaxBackoff,
+}
+
+// sleep waits between attempts, replaced in tests
+var sleep = time.Sleep
+
+func newRetryPolicy(config retryConfig) (retryPolicy, error) {
+	policy := retry
+	var err error
+	if config.MaxAttempts < 0 {
+		return policy, fmt.Errorf("Invalid retry max attempts %d", config.MaxAttempts)
+	}
+	if config.MaxAttempts > 0 {
+		policy.maxAttempts = config.MaxAttempts
+	}
+	if config.MinBackoff != "" {
+		if policy.minBackoff, err = time.ParseDuration(config.MinBackoff); err != nil || policy.minBackoff < 0 {
+			return policy, fmt.Errorf("Invalid retry min backoff %s", config.MinBackoff)
+		}
+	}
+	if config.MaxBackoff != "" {
+		if policy.maxBackoff, err = time.ParseDuration(config.MaxBackoff); err != nil || policy.maxBackoff < 0 {
+			return policy, fmt.Errorf("Invalid retry max backoff %s", config.MaxBackoff)
+		}
+	}
+	if policy.maxBackoff < policy.minBackoff {
+		return policy, fmt.Errorf("Retry max backoff %s is less than min backoff %s", policy.maxBackoff, policy.minBackoff)
+	}
+	return policy, nil
+}
+
+// retryClassifier decides whether the outcome of an attempt should be retried
+type retryClassifier func(resp *http.Response, err error) bool
+
+// retryIdempotent retries connection errors, throttling and server errors,
+// which is safe for requests without side effects such as the challenge
+func retryIdempotent(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// retryThrottled only retries responses in which the server asks to try
+// again later, for requests that may not be safe to repeat
+func retryThrottled(resp *http.Response, err error) bool {
+	if err != nil {
+		return false
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// do sends the request built by newRequest until it succeeds, the classifier
+// declines to retry or the attempts are exhausted. The response of the last
+// attempt is returned.
+func (p retryPolicy) do(newRequest func() *http.Request, shouldRetry retryClassifier) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		r := newRequest()
+		resp, err := client.Do(r)
+		if attempt >= p.maxAttempts || !shouldRetry(resp, err) {
+			return resp, err
+		}
+
+		wait := p.backoff(attempt)
+		fields := logrus.Fields{
+			"url":     r.URL.String(),
+			"attempt": attempt,
+			"wait":    wait.String(),
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+		} else {
+			fields["status"] = resp.StatusCode
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				wait = p.capBackoff(retryAfter)
+				fields["wait"] = wait.String()
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		logrus.WithFields(fields).Debug("Retrying request")
+		sleep(wait)
+	}
+}
+
+// backoff is the wait after the given attempt, doubling from minBackoff up to
+// maxBackoff, with a random jitter of up to half the wait
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	wait := p.minBackoff
+	for i := 1; i < attempt && wait < p.maxBackoff; i++ {
+		wait *= 2
+	}
+	wait = p.capBackoff(wait)
+	if half := int64(wait / 2); half > 0 {
+		wait = time.Duration(half + rand.Int63n(half+1))
+	}
+	return wait
+}
+
+func (p retryPolicy) capBackoff(wait time.Duration) time.Duration {
+	if wait > p.maxBackoff {
+		return p.maxBackoff
+	}
+	return wait
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		wait := date.Sub(time.Now())
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyHandler fails the first failures requests with status before
+// passing requests on to next
+type flakyHandler struct {
+	mutex      sync.Mutex
+	failures   int
+	status     int
+	retryAfter string
+	requests   int
+	next       http.Handler
+}
+
+func (h *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	h.requests++
+	fail := h.requests <= h.failures
+	h.mutex.Unlock()
+	if fail {
+		if h.retryAfter != "" {
+			w.Header().Set("Retry-After", h.retryAfter)
+		}
+		w.WriteHeader(h.status)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// useTestRetry installs a retry policy that records waits instead of sleeping
+func useTestRetry(maxAttempts int) (*[]time.Duration, func()) {
+	oldRetry, oldSleep := retry, sleep
+	var waits []time.Duration
+	retry = retryPolicy{maxAttempts: maxAttempts, minBackoff: 100 * time.Millisecond, maxBackoff: 10 * time.Second}
+	sleep = func(d time.Duration) { waits = append(waits, d) }
+	return &waits, func() { retry, sleep = oldRetry, oldSleep }
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	testCases := []struct {
+		name        string
+		failures    int
+		status      int
+		retryAfter  string
+		maxAttempts int
+		classifier  retryClassifier
+		requests    int
+		finalStatus int
+	}{
+		{name: "success", failures: 0, status: 503, maxAttempts: 3, classifier: retryIdempotent, requests: 1, finalStatus: 200},
+		{name: "recovers", failures: 2, status: 502, maxAttempts: 3, classifier: retryIdempotent, requests: 3, finalStatus: 200},
+		{name: "exhausted", failures: 5, status: 500, maxAttempts: 3, classifier: retryIdempotent, requests: 3, finalStatus: 500},
+		{name: "disabled", failures: 1, status: 503, maxAttempts: 1, classifier: retryIdempotent, requests: 1, finalStatus: 503},
+		{name: "throttled", failures: 2, status: 429, maxAttempts: 3, classifier: retryThrottled, requests: 3, finalStatus: 200},
+		{name: "not throttled", failures: 1, status: 500, maxAttempts: 3, classifier: retryThrottled, requests: 1, finalStatus: 500},
+		{name: "client error", failures: 1, status: 401, maxAttempts: 3, classifier: retryIdempotent, requests: 1, finalStatus: 401},
+	}
+	for _, tc := range testCases {
+		waits, restore := useTestRetry(tc.maxAttempts)
+		handler := &flakyHandler{
+			failures: tc.failures,
+			status:   tc.status,
+			next:     http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		}
+		server := httptest.NewServer(handler)
+
+		resp, err := retry.do(func() *http.Request {
+			r, _ := http.NewRequest("GET", server.URL, nil)
+			return r
+		}, tc.classifier)
+		if assert.NoError(t, err, tc.name) {
+			assert.Equal(t, tc.finalStatus, resp.StatusCode, tc.name)
+			resp.Body.Close()
+		}
+		assert.Equal(t, tc.requests, handler.requests, tc.name)
+		assert.Len(t, *waits, tc.requests-1, tc.name)
+
+		server.Close()
+		restore()
+	}
+}
+
+func TestRetryHonorsRetryAfter(t *testing.T) {
+	waits, restore := useTestRetry(3)
+	defer restore()
+	handler := &flakyHandler{
+		failures:   2,
+		status:     503,
+		retryAfter: "2",
+		next:       http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := retry.do(func() *http.Request {
+		r, _ := http.NewRequest("GET", server.URL, nil)
+		return r
+	}, retryThrottled)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, []time.Duration{2 * time.Second, 2 * time.Second}, *waits)
+}
+
+func TestRetryBackoffBounds(t *testing.T) {
+	policy := retryPolicy{maxAttempts: 10, minBackoff: 100 * time.Millisecond, maxBackoff: time.Second}
+	for attempt := 1; attempt < 10; attempt++ {
+		wait := policy.backoff(attempt)
+		assert.True(t, wait >= 50*time.Millisecond, "attempt %d waits %s", attempt, wait)
+		assert.True(t, wait <= time.Second, "attempt %d waits %s", attempt, wait)
+	}
+	assert.True(t, policy.backoff(9) >= 500*time.Millisecond)
+
+	wait, ok := parseRetryAfter(time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), wait)
+	_, ok = parseRetryAfter("soon")
+	assert.False(t, ok)
+}
+
+func TestNewRetryPolicy(t *testing.T) {
+	policy, err := newRetryPolicy(retryConfig{MaxAttempts: 5, MinBackoff: "1s", MaxBackoff: "10s"})
+	assert.NoError(t, err)
+	assert.Equal(t, retryPolicy{maxAttempts: 5, minBackoff: time.Second, maxBackoff: 10 * time.Second}, policy)
+
+	_, err = newRetryPolicy(retryConfig{MinBackoff: "10s", MaxBackoff: "1s"})
+	assert.Error(t, err)
+	_, err = newRetryPolicy(retryConfig{MaxAttempts: -1})
+	assert.Error(t, err)
+}
+
+func TestGetRetriesFlakyRegistry(t *testing.T) {
+	defer useInsecureClient()()
+	_, restore := useTestRetry(4)
+	defer restore()
+	refreshed := makeAcrToken(time.Now().Add(3*time.Hour), "tenant", "new")
+	registry := newFakeRegistry(refreshed)
+	defer registry.Close()
+	handler := &flakyHandler{failures: 3, status: 503, next: registry.server.Config.Handler}
+	registry.server.Config.Handler = handler
+
+	store := newMemoryStore()
+	store.Store(dockerTypes.AuthConfig{
+		ServerAddress: registry.host(),
+		Username:      tokenUsername,
+		IdentityToken: makeAcrToken(time.Now().Add(-time.Hour), "tenant", "old"),
+	})
+
+	_, cred, err := newTestWrapper(store).Get(registry.host())
+	assert.NoError(t, err)
+	assert.Equal(t, refreshed, cred)
+	assert.Equal(t, 5, handler.requests)
+	assert.Equal(t, 1, registry.exchangeCount())
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// credentialStatus describes a stored credential without revealing its secret
+type credentialStatus struct {
+	Server   string `json:"server"`
+	Username string `json:"username"`
+	Backend  string `json:"backend"`
+	// Tenant, Expiry and Remaining are only known for ACR identity tokens
+	Tenant        string `json:"tenant,omitempty"`
+	Expiry        string `json:"expiry,omitempty"`
+	Remaining     string `json:"remaining,omitempty"`
+	ExpiredOrNear bool   `json:"expiredOrNear"`
+	// Error tells why an identity token could not be parsed
+	Error string `json:"error,omitempty"`
+}
+
+func newStatusCommand(wrapper *storeWrapper, out io.Writer) *cobra.Command {
+	var jsonOutput bool
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the stored credentials and when their tokens expire.",
+		Long:  "Show the stored credentials, the tenant and expiry of their ACR tokens and the store they live in.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			statuses, err := wrapper.status()
+			if err != nil {
+				return err
+			}
+			if jsonOutput {
+				return writeStatusJSON(out, statuses)
+			}
+			return writeStatusTable(out, statuses)
+		},
+	}
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the status as JSON.")
+	return cmd
+}
+
+// status describes every stored credential, sorted by server
+func (w *storeWrapper) status() ([]credentialStatus, error) {
+	store := *w.store
+	auths, err := store.GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("Error listing stored credentials, error: %s", err)
+	}
+	statuses := make([]credentialStatus, 0, len(auths))
+	for server, auth := range auths {
+		status := credentialStatus{
+			Server:   server,
+			Username: auth.Username,
+			Backend:  w.backend,
+		}
+		if status.Username == "" {
+			status.Username = tokenUsername
+		}
+		if status.Username == tokenUsername && auth.IdentityToken != "" {
+			if acrToken, err := parseAcrToken(auth.IdentityToken); err != nil {
+				status.Error = err.Error()
+			} else {
+				expiry := time.Unix(acrToken.Expiration, 0)
+				status.Tenant = acrToken.TenantID
+				status.Expiry = expiry.UTC().Format(time.RFC3339)
+				status.Remaining = remainingTime(expiry).String()
+				status.ExpiredOrNear = acrToken.isExpiredOrNear()
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Server < statuses[j].Server
+	})
+	return statuses, nil
+}
+
+// remainingTime is the time left until expiry in whole seconds, or zero once
+// expired
+func remainingTime(expiry time.Time) time.Duration {
+	remaining := expiry.Sub(time.Now())
+	if remaining < 0 {
+		return 0
+	}
+	return remaining / time.Second * time.Second
+}
+
+func writeStatusJSON(out io.Writer, statuses []credentialStatus) error {
+	bytes, err := json.MarshalIndent(statuses, "", "\t")
+	if err != nil {
+		return fmt.Errorf("Error trying to marshal status, err: %s", err)
+	}
+	_, err = fmt.Fprintln(out, string(bytes))
+	return err
+}
+
+func writeStatusTable(out io.Writer, statuses []credentialStatus) error {
+	table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "SERVER\tUSERNAME\tTENANT\tEXPIRY\tREMAINING\tEXPIRED OR NEAR\tBACKEND")
+	for _, status := range statuses {
+		tenant, expiry, remaining, expiredOrNear := "-", "-", "-", "-"
+		if status.Error != "" {
+			expiry = "invalid token"
+		} else if status.Expiry != "" {
+			expiry, remaining = status.Expiry, status.Remaining
+			if status.Tenant != "" {
+				tenant = status.Tenant
+			}
+			expiredOrNear = fmt.Sprintf("%t", status.ExpiredOrNear)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			status.Server, status.Username, tenant, expiry, remaining, expiredOrNear, status.Backend)
+	}
+	return table.Flush()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func newStatusTestWrapper() *storeWrapper {
+	store := newMemoryStore()
+	store.Store(dockerTypes.AuthConfig{
+		ServerAddress: "valid.azurecr.io",
+		Username:      tokenUsername,
+		IdentityToken: makeAcrToken(time.Now().Add(2*time.Hour), "tenant-a", "valid"),
+	})
+	store.Store(dockerTypes.AuthConfig{
+		ServerAddress: "near.azurecr.io",
+		IdentityToken: makeAcrToken(time.Now().Add(time.Minute), "tenant-b", "near"),
+	})
+	store.Store(dockerTypes.AuthConfig{
+		ServerAddress: "broken.azurecr.io",
+		Username:      tokenUsername,
+		IdentityToken: "not-a-token",
+	})
+	store.Store(dockerTypes.AuthConfig{
+		ServerAddress: "docker.io",
+		Username:      "user",
+		Password:      "password",
+	})
+	wrapper := newTestWrapper(store)
+	wrapper.backend = "docker-credential-test"
+	return wrapper
+}
+
+func runStatusCommand(t *testing.T, wrapper *storeWrapper, args ...string) string {
+	var out bytes.Buffer
+	cmd := newAdminCommand(wrapper, &out)
+	cmd.SetArgs(append([]string{"status"}, args...))
+	assert.NoError(t, cmd.Execute())
+	return out.String()
+}
+
+func TestStatusJSON(t *testing.T) {
+	output := runStatusCommand(t, newStatusTestWrapper(), "--json")
+
+	var statuses []credentialStatus
+	assert.NoError(t, json.Unmarshal([]byte(output), &statuses))
+	assert.Len(t, statuses, 4)
+
+	byServer := make(map[string]credentialStatus)
+	var servers []string
+	for _, status := range statuses {
+		byServer[status.Server] = status
+		servers = append(servers, status.Server)
+		assert.Equal(t, "docker-credential-test", status.Backend)
+	}
+	assert.Equal(t, []string{"broken.azurecr.io", "docker.io", "near.azurecr.io", "valid.azurecr.io"}, servers)
+
+	valid := byServer["valid.azurecr.io"]
+	assert.Equal(t, tokenUsername, valid.Username)
+	assert.Equal(t, "tenant-a", valid.Tenant)
+	assert.False(t, valid.ExpiredOrNear)
+	remaining, err := time.ParseDuration(valid.Remaining)
+	assert.NoError(t, err)
+	assert.True(t, remaining > 119*time.Minute && remaining <= 2*time.Hour, "remaining %s", remaining)
+	_, err = time.Parse(time.RFC3339, valid.Expiry)
+	assert.NoError(t, err)
+
+	near := byServer["near.azurecr.io"]
+	assert.Equal(t, tokenUsername, near.Username)
+	assert.Equal(t, "tenant-b", near.Tenant)
+	assert.True(t, near.ExpiredOrNear)
+
+	broken := byServer["broken.azurecr.io"]
+	assert.NotEmpty(t, broken.Error)
+	assert.Empty(t, broken.Expiry)
+
+	password := byServer["docker.io"]
+	assert.Equal(t, "user", password.Username)
+	assert.Empty(t, password.Expiry)
+	assert.Empty(t, password.Error)
+
+	assert.NotContains(t, output, "password\"")
+	assert.NotContains(t, output, "not-a-token")
+}
+
+func TestStatusTable(t *testing.T) {
+	output := runStatusCommand(t, newStatusTestWrapper())
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	assert.Len(t, lines, 5)
+	assert.Equal(t, []string{"SERVER", "USERNAME", "TENANT", "EXPIRY", "REMAINING", "EXPIRED", "OR", "NEAR", "BACKEND"}, strings.Fields(lines[0]))
+
+	broken := strings.Fields(lines[1])
+	assert.Equal(t, "broken.azurecr.io", broken[0])
+	assert.Contains(t, lines[1], "invalid token")
+
+	password := strings.Fields(lines[2])
+	assert.Equal(t, []string{"docker.io", "user", "-", "-", "-", "-", "docker-credential-test"}, password)
+
+	near := strings.Fields(lines[3])
+	assert.Equal(t, "near.azurecr.io", near[0])
+	assert.Equal(t, "tenant-b", near[2])
+	assert.Equal(t, "true", near[5])
+
+	valid := strings.Fields(lines[4])
+	assert.Equal(t, "valid.azurecr.io", valid[0])
+	assert.Equal(t, "tenant-a", valid[2])
+	assert.Equal(t, "false", valid[5])
+}
+
+func TestIsAdminCommand(t *testing.T) {
+	cmd := newAdminCommand(newTestWrapper(newMemoryStore()), &bytes.Buffer{})
+	assert.True(t, isAdminCommand(cmd, []string{"status"}))
+	assert.True(t, isAdminCommand(cmd, []string{"status", "--json"}))
+	assert.False(t, isAdminCommand(cmd, []string{"get"}))
+	assert.False(t, isAdminCommand(cmd, []string{"store"}))
+	assert.False(t, isAdminCommand(cmd, nil))
+}
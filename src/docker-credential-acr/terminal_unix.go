@@ -0,0 +1,7 @@
+// +build !windows
+
+package main
+
+// controllingTerminal is the terminal of the process, which docker does not
+// capture like the output of credential helpers
+const controllingTerminal = "/dev/tty"
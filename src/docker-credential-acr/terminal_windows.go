@@ -0,0 +1,7 @@
+// +build windows
+
+package main
+
+// controllingTerminal is the console of the process, which docker does not
+// capture like the output of credential helpers
+const controllingTerminal = "CONOUT$"
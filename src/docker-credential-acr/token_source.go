@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Sirupsen/logrus"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// TokenSource acquires AAD access tokens that the registry can exchange for
+// an ACR refresh token, without requiring a prior 'az acr login'
+type TokenSource interface {
+	// AccessToken returns an AAD access token for the Azure resource manager
+	AccessToken() (string, error)
+}
+
+const (
+	envTenantID        = "AZURE_TENANT_ID"
+	envClientID        = "AZURE_CLIENT_ID"
+	envClientSecret    = "AZURE_CLIENT_SECRET"
+	envClientCertPath  = "AZURE_CLIENT_CERTIFICATE_PATH"
+	envAuthorityHost   = "AZURE_AUTHORITY_HOST"
+	envManagedIdentity = "DOCKER_CREDENTIAL_ACR_MANAGED_IDENTITY"
+	envDeviceLogin     = "DOCKER_CREDENTIAL_ACR_DEVICE_LOGIN"
+
+	defaultAuthorityHost = "https://login.microsoftonline.com/"
+	armResource          = "https://management.azure.com/"
+	imdsAPIVersion       = "2018-02-01"
+	// public client id of the Azure CLI, used for device code login
+	deviceLoginClientID = "04b07795-8ddb-461a-bbee-02f9e1bf7b46"
+	deviceLoginTenant   = "common"
+)
+
+// imdsEndpoint is the Azure instance metadata service token endpoint
+var imdsEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// newTokenSourceFromEnv picks a token source from the environment, in order:
+// service principal with client secret, service principal with client
+// certificate, managed identity and interactive device code login. It returns
+// nil if none is configured.
+func newTokenSourceFromEnv() (TokenSource, error) {
+	clientID := os.Getenv(envClientID)
+	if secret := os.Getenv(envClientSecret); secret != "" {
+		oauthConfig, err := newOAuthConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return newClientSecretTokenSource(*oauthConfig, clientID, secret)
+	}
+	if certPath := os.Getenv(envClientCertPath); certPath != "" {
+		oauthConfig, err := newOAuthConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return newClientCertificateTokenSource(*oauthConfig, clientID, certPath)
+	}
+	if strings.EqualFold(os.Getenv(envManagedIdentity), "true") {
+		return &managedIdentityTokenSource{
+			endpoint: imdsEndpoint,
+			clientID: clientID,
+		}, nil
+	}
+	if strings.EqualFold(os.Getenv(envDeviceLogin), "true") {
+		return newDeviceCodeTokenSourceFromEnv()
+	}
+	return nil, nil
+}
+
+func newOAuthConfigFromEnv() (*adal.OAuthConfig, error) {
+	tenant := os.Getenv(envTenantID)
+	if tenant == "" {
+		return nil, fmt.Errorf("%s is required to log in with a service principal", envTenantID)
+	}
+	if os.Getenv(envClientID) == "" {
+		return nil, fmt.Errorf("%s is required to log in with a service principal", envClientID)
+	}
+	authorityHost := os.Getenv(envAuthorityHost)
+	if authorityHost == "" {
+		authorityHost = defaultAuthorityHost
+	}
+	oauthConfig, err := adal.NewOAuthConfig(authorityHost, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid authority host %s, error: %s", authorityHost, err)
+	}
+	return oauthConfig, nil
+}
+
+// adalTokenSource acquires tokens through a service principal token from adal
+type adalTokenSource struct {
+	token *adal.ServicePrincipalToken
+}
+
+func (s *adalTokenSource) AccessToken() (string, error) {
+	logrus.Debug("Requesting AAD token for service principal")
+	if err := s.token.EnsureFresh(); err != nil {
+		return "", fmt.Errorf("Error acquiring AAD token, error: %s", err)
+	}
+	return s.token.OAuthToken(), nil
+}
+
+func newClientSecretTokenSource(oauthConfig adal.OAuthConfig, clientID string, secret string) (TokenSource, error) {
+	token, err := adal.NewServicePrincipalToken(oauthConfig, clientID, secret, armResource)
+	if err != nil {
+		return nil, err
+	}
+	token.SetSender(client)
+	return &adalTokenSource{token: token}, nil
+}
+
+func newClientCertificateTokenSource(oauthConfig adal.OAuthConfig, clientID string, certPath string) (TokenSource, error) {
+	certificate, privateKey, err := loadCertificate(certPath)
+	if err != nil {
+		return nil, err
+	}
+	token, err := adal.NewServicePrincipalTokenFromCertificate(oauthConfig, clientID, certificate, privateKey, armResource)
+	if err != nil {
+		return nil, err
+	}
+	token.SetSender(client)
+	return &adalTokenSource{token: token}, nil
+}
+
+// loadCertificate reads a PEM file holding a certificate and its RSA private key
+func loadCertificate(certPath string) (certificate *x509.Certificate, privateKey *rsa.PrivateKey, err error) {
+	var content []byte
+	if content, err = ioutil.ReadFile(certPath); err != nil {
+		return nil, nil, fmt.Errorf("Error reading client certificate %s, error: %s", certPath, err)
+	}
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			if certificate == nil {
+				if certificate, err = x509.ParseCertificate(block.Bytes); err != nil {
+					return nil, nil, fmt.Errorf("Error parsing client certificate %s, error: %s", certPath, err)
+				}
+			}
+		case "RSA PRIVATE KEY":
+			if privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, nil, fmt.Errorf("Error parsing private key in %s, error: %s", certPath, err)
+			}
+		case "PRIVATE KEY":
+			var key interface{}
+			if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+				return nil, nil, fmt.Errorf("Error parsing private key in %s, error: %s", certPath, err)
+			}
+			var ok bool
+			if privateKey, ok = key.(*rsa.PrivateKey); !ok {
+				return nil, nil, fmt.Errorf("Private key in %s is not an RSA key", certPath)
+			}
+		}
+	}
+	if certificate == nil || privateKey == nil {
+		return nil, nil, fmt.Errorf("Client certificate %s must contain a certificate and an RSA private key", certPath)
+	}
+	return certificate, privateKey, nil
+}
+
+// deviceCodeTokenSource acquires tokens interactively through the AAD device
+// code flow, writing the login instructions to the terminal it opens
+type deviceCodeTokenSource struct {
+	oauthConfig  adal.OAuthConfig
+	clientID     string
+	openTerminal func() (io.WriteCloser, error)
+}
+
+func newDeviceCodeTokenSourceFromEnv() (TokenSource, error) {
+	tenant := os.Getenv(envTenantID)
+	if tenant == "" {
+		tenant = deviceLoginTenant
+	}
+	authorityHost := os.Getenv(envAuthorityHost)
+	if authorityHost == "" {
+		authorityHost = defaultAuthorityHost
+	}
+	oauthConfig, err := adal.NewOAuthConfig(authorityHost, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid authority host %s, error: %s", authorityHost, err)
+	}
+	return &deviceCodeTokenSource{
+		oauthConfig:  *oauthConfig,
+		clientID:     deviceLoginClientID,
+		openTerminal: openControllingTerminal,
+	}, nil
+}
+
+// openControllingTerminal opens the terminal docker runs in for writing. Docker
+// captures the stdout and stderr of credential helpers, so instructions written
+// there would never be shown.
+func openControllingTerminal() (io.WriteCloser, error) {
+	terminal, err := os.OpenFile(controllingTerminal, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, &noTerminalError{device: controllingTerminal, cause: err}
+	}
+	return terminal, nil
+}
+
+// AccessToken fails before starting the login when there is no terminal to
+// show the instructions on, rather than waiting for a code nobody can see
+func (s *deviceCodeTokenSource) AccessToken() (string, error) {
+	terminal, err := s.openTerminal()
+	if err != nil {
+		return "", err
+	}
+	defer terminal.Close()
+	logrus.WithField("url", s.oauthConfig.DeviceCodeEndpoint.String()).Debug("Starting device code login")
+	code, err := adal.InitiateDeviceAuth(client, s.oauthConfig, s.clientID, armResource)
+	if err != nil {
+		return "", fmt.Errorf("Error starting device code login, error: %s", err)
+	}
+	if code.Message != nil {
+		fmt.Fprintln(terminal, *code.Message)
+	}
+	token, err := adal.WaitForUserCompletion(client, code)
+	if err != nil {
+		return "", fmt.Errorf("Error completing device code login, error: %s", err)
+	}
+	return token.AccessToken, nil
+}
+
+// managedIdentityTokenSource acquires tokens from the instance metadata service
+type managedIdentityTokenSource struct {
+	endpoint string
+	clientID string
+}
+
+func (s *managedIdentityTokenSource) AccessToken() (string, error) {
+	var err error
+	var endpointURL *url.URL
+	if endpointURL, err = url.Parse(s.endpoint); err != nil {
+		return "", fmt.Errorf("Invalid managed identity endpoint %s", s.endpoint)
+	}
+	query := url.Values{
+		"api-version": []string{imdsAPIVersion},
+		"resource":    []string{armResource},
+	}
+	if s.clientID != "" {
+		query.Set("client_id", s.clientID)
+	}
+	endpointURL.RawQuery = query.Encode()
+
+	var r *http.Request
+	r, _ = http.NewRequest("GET", endpointURL.String(), nil)
+	r.Header.Add("Metadata", "true")
+	r.Header.Add(userAgentHeader, getUserAgent())
+
+	logrus.WithField("url", s.endpoint).Debug("Requesting managed identity token")
+	var resp *http.Response
+	if resp, err = client.Do(r); err != nil {
+		return "", fmt.Errorf("Error reaching managed identity endpoint %s, error: %s", s.endpoint, err)
+	}
+	defer resp.Body.Close()
+	logrus.WithFields(logrus.Fields{
+		"url":    s.endpoint,
+		"status": resp.StatusCode,
+	}).Debug("Received managed identity response")
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("Managed identity endpoint %s responded with status code %d", s.endpoint, resp.StatusCode)
+	}
+
+	var token adal.Token
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("Unable to read response from managed identity endpoint %s", s.endpoint)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("Managed identity endpoint %s did not return an access token", s.endpoint)
+	}
+	return token.AccessToken, nil
+}
+
+// acquireRefreshToken logs in to the registry with an AAD access token from
+// the given source and returns the ACR refresh token issued for it
+func acquireRefreshToken(serverAddress string, source TokenSource) (string, error) {
+	var err error
+	var challenge *authDirective
+	if challenge, err = receiveChallengeFromLoginServer(serverAddress); err != nil {
+		return "", err
+	}
+	var accessToken string
+	if accessToken, err = source.AccessToken(); err != nil {
+		return "", err
+	}
+	var tenant string
+	if tenant, err = parseAccessTokenTenant(accessToken); err != nil {
+		return "", err
+	}
+	var refreshToken string
+	if refreshToken, err = performAccessTokenExchange(serverAddress, challenge, tenant, accessToken); err != nil {
+		return "", err
+	}
+	if err = verifyTenant(serverAddress, tenant, refreshToken); err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
+
+func parseAccessTokenTenant(accessToken string) (string, error) {
+	tokenSegments := strings.Split(accessToken, ".")
+	if len(tokenSegments) < 2 {
+		return "", fmt.Errorf("Invalid AAD access token length: %d", len(tokenSegments))
+	}
+	payloadBytes, err := jwt.DecodeSegment(tokenSegments[1])
+	if err != nil {
+		return "", fmt.Errorf("Error decoding payload segment from AAD access token, error: %s", err)
+	}
+	var payload accessTokenPayload
+	if err = json.Unmarshal(payloadBytes, &payload); err != nil {
+		return "", fmt.Errorf("Error unmarshalling AAD access token payload, error: %s", err)
+	}
+	return payload.TenantID, nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeAccessToken(tenant string) string {
+	payload, _ := json.Marshal(map[string]string{"tid": tenant})
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	return fmt.Sprintf("%s.%s.", header, base64.RawURLEncoding.EncodeToString(payload))
+}
+
+// newFakeAAD serves the AAD token endpoint for the given tenant, requiring
+// the client credentials to carry the given form field
+func newFakeAAD(tenant string, requiredField string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(fmt.Sprintf("/%s/oauth2/token", tenant), func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil ||
+			r.PostForm.Get("grant_type") != "client_credentials" ||
+			r.PostForm.Get(requiredField) == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(adal.Token{
+			AccessToken: makeAccessToken(tenant),
+			ExpiresOn:   strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10),
+			Resource:    r.PostForm.Get("resource"),
+			Type:        "Bearer",
+		})
+	})
+	return httptest.NewTLSServer(mux)
+}
+
+func TestClientSecretTokenSource(t *testing.T) {
+	defer useInsecureClient()()
+	aad := newFakeAAD("tenant1", "client_secret")
+	defer aad.Close()
+	refreshed := makeAcrToken(time.Now().Add(3*time.Hour), "tenant1", "sp")
+	registry := newFakeRegistry(refreshed)
+	defer registry.Close()
+
+	oauthConfig, err := adal.NewOAuthConfig(aad.URL, "tenant1")
+	assert.NoError(t, err)
+	source, err := newClientSecretTokenSource(*oauthConfig, "client", "secret")
+	assert.NoError(t, err)
+
+	refreshToken, err := acquireRefreshToken(registry.host(), source)
+	assert.NoError(t, err)
+	assert.Equal(t, refreshed, refreshToken)
+	assert.Equal(t, "access_token", registry.lastForm.Get("grant_type"))
+	assert.Equal(t, "tenant1", registry.lastForm.Get("tenant"))
+	assert.Equal(t, makeAccessToken("tenant1"), registry.lastForm.Get("access_token"))
+}
+
+func TestClientCertificateTokenSource(t *testing.T) {
+	defer useInsecureClient()()
+	aad := newFakeAAD("tenant2", "client_assertion")
+	defer aad.Close()
+	refreshed := makeAcrToken(time.Now().Add(3*time.Hour), "tenant2", "cert")
+	registry := newFakeRegistry(refreshed)
+	defer registry.Close()
+
+	dir, err := ioutil.TempDir("", "acr-cert")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certPath := filepath.Join(dir, "client.pem")
+	assert.NoError(t, writeTestCertificate(certPath))
+
+	oauthConfig, err := adal.NewOAuthConfig(aad.URL, "tenant2")
+	assert.NoError(t, err)
+	source, err := newClientCertificateTokenSource(*oauthConfig, "client", certPath)
+	assert.NoError(t, err)
+
+	refreshToken, err := acquireRefreshToken(registry.host(), source)
+	assert.NoError(t, err)
+	assert.Equal(t, refreshed, refreshToken)
+	assert.Equal(t, "tenant2", registry.lastForm.Get("tenant"))
+}
+
+func TestManagedIdentityTokenSource(t *testing.T) {
+	defer useInsecureClient()()
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("client_id") != "identity" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(adal.Token{AccessToken: makeAccessToken("tenant3")})
+	}))
+	defer imds.Close()
+	refreshed := makeAcrToken(time.Now().Add(3*time.Hour), "tenant3", "msi")
+	registry := newFakeRegistry(refreshed)
+	defer registry.Close()
+
+	source := &managedIdentityTokenSource{endpoint: imds.URL, clientID: "identity"}
+	refreshToken, err := acquireRefreshToken(registry.host(), source)
+	assert.NoError(t, err)
+	assert.Equal(t, refreshed, refreshToken)
+	assert.Equal(t, "tenant3", registry.lastForm.Get("tenant"))
+}
+
+// useAcrDomainSuffix lets the fake registries on the loopback address count as
+// ACR login servers
+func useAcrDomainSuffix(suffix string) func() {
+	oldSuffixes := acrDomainSuffixes
+	acrDomainSuffixes = append([]string{suffix}, oldSuffixes...)
+	return func() { acrDomainSuffixes = oldSuffixes }
+}
+
+func TestGetLogsInWithTokenSource(t *testing.T) {
+	defer useInsecureClient()()
+	defer useAcrDomainSuffix("127.0.0.1")()
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(adal.Token{AccessToken: makeAccessToken("tenant")})
+	}))
+	defer imds.Close()
+	refreshed := makeAcrToken(time.Now().Add(3*time.Hour), "tenant", "msi")
+	registry := newFakeRegistry(refreshed)
+	defer registry.Close()
+
+	store := newMemoryStore()
+	wrapper := newTestWrapper(store)
+	wrapper.tokenSource = &managedIdentityTokenSource{endpoint: imds.URL}
+
+	user, cred, err := wrapper.Get(registry.host())
+	assert.NoError(t, err)
+	assert.Equal(t, tokenUsername, user)
+	assert.Equal(t, refreshed, cred)
+	assert.Equal(t, refreshed, store.auths[registry.host()].IdentityToken)
+}
+
+func TestNewTokenSourceFromEnvRequiresTenant(t *testing.T) {
+	for _, key := range []string{envTenantID, envClientID, envClientSecret, envClientCertPath, envManagedIdentity, envDeviceLogin} {
+		defer os.Setenv(key, os.Getenv(key))
+		os.Unsetenv(key)
+	}
+
+	source, err := newTokenSourceFromEnv()
+	assert.NoError(t, err)
+	assert.Nil(t, source)
+
+	os.Setenv(envClientID, "client")
+	os.Setenv(envClientSecret, "secret")
+	_, err = newTokenSourceFromEnv()
+	assert.Error(t, err)
+
+	os.Setenv(envTenantID, "tenant")
+	source, err = newTokenSourceFromEnv()
+	assert.NoError(t, err)
+	assert.IsType(t, &adalTokenSource{}, source)
+}
+
+func writeTestCertificate(path string) error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "acr-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	content := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	content = append(content, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})...)
+	return ioutil.WriteFile(path, content, 0600)
+}
+
+func TestDeviceCodeTokenSource(t *testing.T) {
+	defer useInsecureClient()()
+	var polls int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/common/oauth2/devicecode", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"device_code":"device","user_code":"USER","interval":"0","expires_in":"60","message":"enter USER"}`)
+	})
+	mux.HandleFunc("/common/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("code") != "device" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		polls++
+		if polls == 1 {
+			fmt.Fprint(w, `{"error":"authorization_pending"}`)
+			return
+		}
+		json.NewEncoder(w).Encode(adal.Token{AccessToken: makeAccessToken("tenant4")})
+	})
+	aad := httptest.NewTLSServer(mux)
+	defer aad.Close()
+	refreshed := makeAcrToken(time.Now().Add(3*time.Hour), "tenant4", "device")
+	registry := newFakeRegistry(refreshed)
+	defer registry.Close()
+
+	oauthConfig, err := adal.NewOAuthConfig(aad.URL, deviceLoginTenant)
+	assert.NoError(t, err)
+	var output bytes.Buffer
+	source := &deviceCodeTokenSource{
+		oauthConfig:  *oauthConfig,
+		clientID:     deviceLoginClientID,
+		openTerminal: func() (io.WriteCloser, error) { return nopWriteCloser{&output}, nil },
+	}
+
+	refreshToken, err := acquireRefreshToken(registry.host(), source)
+	assert.NoError(t, err)
+	assert.Equal(t, refreshed, refreshToken)
+	assert.Equal(t, "enter USER\n", output.String())
+	assert.Equal(t, 2, polls)
+	assert.Equal(t, "tenant4", registry.lastForm.Get("tenant"))
+}
+
+func TestDeviceCodeTokenSourceWithoutTerminal(t *testing.T) {
+	defer useInsecureClient()()
+	var started int
+	aad := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer aad.Close()
+	registry := newFakeRegistry(makeAcrToken(time.Now().Add(3*time.Hour), "tenant4", "device"))
+	defer registry.Close()
+
+	oauthConfig, err := adal.NewOAuthConfig(aad.URL, deviceLoginTenant)
+	assert.NoError(t, err)
+	source := &deviceCodeTokenSource{
+		oauthConfig: *oauthConfig,
+		clientID:    deviceLoginClientID,
+		openTerminal: func() (io.WriteCloser, error) {
+			return nil, &noTerminalError{device: controllingTerminal, cause: fmt.Errorf("no such device or address")}
+		},
+	}
+
+	_, err = acquireRefreshToken(registry.host(), source)
+	assert.True(t, isNoTerminal(err), "%v", err)
+	assert.Equal(t, 0, started)
+	assert.Equal(t, 0, registry.exchangeCount())
+}
+
+// nopWriteCloser stands in for the terminal in tests
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func TestTokenSourceLoginOnlyForAcrHosts(t *testing.T) {
+	wrapper := newTestWrapper(newMemoryStore())
+	assert.False(t, wrapper.canLoginWithTokenSource("myregistry.azurecr.io"))
+
+	wrapper.tokenSource = &deviceCodeTokenSource{}
+	assert.True(t, wrapper.canLoginWithTokenSource("myregistry.azurecr.io"))
+	assert.True(t, wrapper.canLoginWithTokenSource("https://myregistry.azurecr.cn"))
+	assert.False(t, wrapper.canLoginWithTokenSource("index.docker.io"))
+	assert.False(t, wrapper.canLoginWithTokenSource("127.0.0.1:5000"))
+
+	wrapper.tokenSource = &managedIdentityTokenSource{}
+	assert.True(t, wrapper.canLoginWithTokenSource("myregistry.azurecr.io"))
+	assert.False(t, wrapper.canLoginWithTokenSource("https://index.docker.io/v1/"))
+	assert.False(t, wrapper.canLoginWithTokenSource("127.0.0.1:5000"))
+}
+
+func TestGetSkipsTokenSourceForOtherRegistries(t *testing.T) {
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected token request for %s", r.URL)
+	}))
+	defer imds.Close()
+	wrapper := newTestWrapper(newMemoryStore())
+	wrapper.tokenSource = &managedIdentityTokenSource{endpoint: imds.URL}
+
+	for _, serverURL := range []string{"https://index.docker.io/v1/", "ghcr.io"} {
+		user, cred, err := wrapper.Get(serverURL)
+		assert.NoError(t, err, serverURL)
+		assert.Empty(t, user, serverURL)
+		assert.Empty(t, cred, serverURL)
+	}
+}